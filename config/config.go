@@ -8,8 +8,8 @@ import (
 )
 
 type Config struct {
-	Listen    []ServerConfig `json:"listen,omitempty"`    // supports http, socks5, grpc and h2 protocols
-	Transport []ServerConfig `json:"transport,omitempty"` // supports grpc, h2 and shadowsocks protocols
+	Listen    []ServerConfig `json:"listen,omitempty"`    // supports http, socks5, mixed, dns, redirect, tproxy, forward, grpc, h2, ws, quic, trojan and shadowsocks protocols
+	Transport []ServerConfig `json:"transport,omitempty"` // supports grpc, h2, ws, quic, trojan, shadowsocks, http, https and socks5 protocols
 
 	// Bypass specifies a string that contains comma-separated values
 	// specifying hosts that should be excluded from proxying. Each value is
@@ -24,33 +24,162 @@ type Config struct {
 	// specifying hosts that should be blocked from proxying.
 	// Block has priority over Bypass.
 	Block string `json:"block,omitempty"`
+
+	// GeoIP and GeoSite specify the path of MaxMind-format GeoIP database
+	// and v2ray-style geosite.dat file. Once specified, values like
+	// "geoip:cn" and "geosite:google" can be used in Bypass and Block,
+	// as well as rule types geoip and geosite, e.g. "geoip,cn,direct".
+	GeoIP   string `json:"geoip,omitempty"`
+	GeoSite string `json:"geosite,omitempty"`
+
+	// ResolveIP enables resolving the domain name locally, when no rule
+	// matches it except the final rule, so that the resolved IP can be
+	// tested against IP rules such as ip-cidr, geoip and the IP values
+	// of Bypass and Block. Note that the DNS query may leak to local resolver.
+	ResolveIP bool `json:"resolve_ip,omitempty"`
+
+	// Rules specifies an ordered list of routing rules, the first matched
+	// rule wins. Each rule is represented by "TYPE,VALUE,ACTION", where
+	// TYPE is one of domain, domain-suffix, domain-keyword, regex (or
+	// domain-regex), ip-cidr, geoip, geosite, dst-port and inbound, and
+	// ACTION is one of direct, reject, proxy or the name of a transport or group.
+	// The special rule "final,ACTION" matches any connection.
+	// Connections that do not match any rule go through proxy.
+	// Block and Bypass are evaluated before Rules.
+	Rules []string `json:"rules,omitempty"`
+
+	// Group specifies outbound groups of named transports, the name of
+	// group can be used as the action of rules or the outbound of listeners.
+	// A group named "proxy" replaces the default group of all transports.
+	Group []GroupConfig `json:"group,omitempty"`
+
+	// Reverse exposes local services on the server through named grpc or h2
+	// transports, the server listener must enable reverse as well.
+	Reverse []ReverseConfig `json:"reverse,omitempty"`
+
+	// HealthCheck applies to groups, including the default proxy group
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+}
+
+// GroupConfig combines transports into an outbound, which periodically
+// checks the health of transports and dials through the healthy ones
+// according to strategy.
+type GroupConfig struct {
+	Name      string   `json:"name,omitempty"`
+	Transport []string `json:"transport,omitempty"` // names of transports
+	// one of latency, round-robin, random and hash, defaults to latency
+	Strategy string `json:"strategy,omitempty"`
+	// for latency strategy, in milliseconds, the group keeps the current
+	// transport unless it is slower than the fastest one beyond tolerance
+	Tolerance int `json:"tolerance,omitempty"`
+	// overrides the HealthCheck of Config if not nil
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+}
+
+// HealthCheck configures the periodic health checks of group
+type HealthCheck struct {
+	// the URL responding status 204, defaults to http://www.gstatic.com/generate_204.
+	// ProbeInBand asks the grpc and h2 servers instead of third-party sites.
+	URL       string `json:"url,omitempty"`
+	Interval  int    `json:"interval,omitempty"`  // in seconds, defaults to 30
+	Timeout   int    `json:"timeout,omitempty"`   // in seconds, defaults to 3
+	Threshold int    `json:"threshold,omitempty"` // consecutive failures to mark a transport unhealthy, defaults to 1
+}
+
+// ProbeInBand is the health check URL that probes the server of transport itself
+const ProbeInBand = "inband"
+
+// strategies of group
+const (
+	StrategyLatency    = "latency"     // the fastest transport
+	StrategyRoundRobin = "round-robin" // healthy transports in turn
+	StrategyRandom     = "random"      // a random healthy transport
+	StrategyHash       = "hash"        // the same transport for the same destination host
+)
+
+// ReverseConfig specifies a reverse tunnel, the server listens on Remote,
+// and each accepted connection is forwarded to Target by the client.
+type ReverseConfig struct {
+	Transport string `json:"transport,omitempty"` // name of grpc or h2 transport
+	Remote    string `json:"remote,omitempty"`    // e.g. 0.0.0.0:2222
+	Target    string `json:"target,omitempty"`    // e.g. 127.0.0.1:22
 }
 
 const (
 	ProtoHTTP   = "http"
+	ProtoHTTPS  = "https" // HTTP proxy over TLS, transport only
 	ProtoSOCKS5 = "socks5"
+	ProtoMixed  = "mixed" // http and socks5 on the same port
+	ProtoDNS    = "dns"
+	// transparent proxy for connections intercepted by
+	// iptables REDIRECT and TPROXY target, Linux only
+	ProtoRedirect = "redirect"
+	ProtoTProxy   = "tproxy"
+	ProtoForward  = "forward" // forwards connections to fixed target
 
 	ProtoGRPC        = "grpc"
 	ProtoHTTP2       = "h2"
+	ProtoWebSocket   = "ws"
+	ProtoQUIC        = "quic"
+	ProtoTrojan      = "trojan"
 	ProtoShadowsocks = "ss"
 )
 
 type ServerConfig struct {
+	// Name identifies the listener or transport in routing rules
+	Name     string `json:"name,omitempty"`
 	Protocol string `json:"protocol,omitempty"`
 	Address  string `json:"address,omitempty"`
 
+	// for local listeners other than grpc and h2, the outbound taken by
+	// action "proxy", which is a transport name or group name.
+	Outbound string `json:"outbound,omitempty"`
+
+	// for grpc, h2, ss, http and https transport, the name of transport
+	// through which it connects to the server, e.g. client -> Via -> this
+	// transport -> destination. The Via transport must be declared before.
+	Via string `json:"via,omitempty"`
+
+	// for forward listener, the destination address of all connections
+	Target string `json:"target,omitempty"`
+
 	// for TLS
 	CertPEM []string `json:"cert_pem,omitempty"`
 	KeyPEM  []string `json:"key_pem,omitempty"`
 	CAPEM   []string `json:"ca_pem,omitempty"`
 
-	// for h2
+	// for h2, ws, http/https/socks5 transport, and http/socks5/mixed listener. Trojan takes Password only
 	Username string `json:"username,omitempty"`
 	Password string `json:"password,omitempty"`
 
+	// for trojan listener, the address of local web server that serves
+	// unauthenticated connections, which are closed if it is empty
+	Fallback string `json:"fallback,omitempty"`
+
+	// for grpc and h2 listener, allows clients to listen on
+	// any address of the server for reverse tunnel
+	Reverse bool `json:"reverse,omitempty"`
+
+	// for ws, the path of WebSocket endpoint, defaults to "/".
+	// Without certificate, the ws listener serves plain HTTP behind
+	// a TLS-terminating reverse proxy, and the ws transport verifies
+	// the server with system root CAs.
+	Path string `json:"path,omitempty"`
+
 	// for shadowsocks
 	Cipher string `json:"cipher,omitempty"`
 	Secret string `json:"secret,omitempty"`
+
+	// for dns listener, queries of proxied domains are sent to Upstream
+	// through the transport using DNS-over-TCP, queries of bypassed domains
+	// are sent to LocalUpstream directly. Upstream defaults to 8.8.8.8:53,
+	// and LocalUpstream defaults to Upstream.
+	Upstream      string `json:"upstream,omitempty"`
+	LocalUpstream string `json:"local_upstream,omitempty"`
+	// FakeIP enables fake-IP mode of dns listener, the proxied domains are
+	// resolved to addresses in this IPv4 CIDR range, e.g. 198.18.0.0/15,
+	// and connections to those addresses are translated back to domains.
+	FakeIP string `json:"fake_ip,omitempty"`
 }
 
 func mergeLine(s []string) string {
@@ -93,6 +222,22 @@ func (s ServerConfig) ServerTLS() (*tls.Config, error) {
 	return newServerTLSConfig(ca, cert, key)
 }
 
+// CertTLS returns server-side TLS config without client authentication,
+// for protocols that authenticate clients by themselves
+func (s ServerConfig) CertTLS() (*tls.Config, error) {
+	if s.CertPEM == nil {
+		return nil, errors.New("no certificate")
+	}
+	if s.KeyPEM == nil {
+		return nil, errors.New("no key")
+	}
+	cert, err := tls.X509KeyPair([]byte(mergeLine(s.CertPEM)), []byte(mergeLine(s.KeyPEM)))
+	if err != nil {
+		return nil, errors.New("parse cert pem: " + err.Error())
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}, nil
+}
+
 // Generate returns a pair of client and server configuration for the given host
 func Generate(host string) (cli, srv Config, err error) {
 	cert, err := newCert(host)
@@ -11,6 +11,12 @@ Example client config:
 		{
 			"protocol": "socks5",
 			"address": "127.0.0.1:1080"
+		},
+		{
+			"protocol": "dns",
+			"address": "127.0.0.1:5353",
+			"upstream": "8.8.8.8:53",
+			"local_upstream": "223.5.5.5:53"
 		}
 	],
 	"transport": [
@@ -52,13 +58,27 @@ Example client config:
 			]
 		},
 		{
+			"name": "ss-server",
 			"protocol": "ss",
 			"address": "example.com:54321",
 			"cipher": "aes-256-gcm",
 			"secret": "examplepass"
 		},
 	],
-	"bypass": "localhost,127.0.0.1,192.168.1.1/16"
+	"bypass": "localhost,127.0.0.1,192.168.1.1/16",
+	"rules": [
+		"domain-suffix,example.org,reject",
+		"domain-suffix,example.net,streaming",
+		"ip-cidr,10.0.0.0/8,direct",
+		"final,proxy"
+	],
+	"group": [
+		{
+			"name": "streaming",
+			"transport": ["ss-server"],
+			"strategy": "hash"
+		}
+	]
 }
 
 Example server config:
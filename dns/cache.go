@@ -0,0 +1,134 @@
+package dns
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	maxCacheSize = 4096
+	maxCacheTTL  = time.Hour
+	// for negative response without SOA record
+	negativeCacheTTL = time.Minute
+)
+
+// cache holds DNS responses until the TTL expires
+type cache struct {
+	mu      sync.Mutex
+	entries map[dnsmessage.Question]cacheEntry
+}
+
+type cacheEntry struct {
+	msg     dnsmessage.Message
+	created time.Time
+	expire  time.Time
+}
+
+func newCache() *cache {
+	return &cache{entries: make(map[dnsmessage.Question]cacheEntry)}
+}
+
+// get returns the cached response of question with the given ID,
+// the TTL of records are decreased by the time elapsed.
+func (c *cache) get(q dnsmessage.Question, id uint16) ([]byte, bool) {
+	key := q
+	key.Name = lowerName(q.Name)
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	now := time.Now()
+	if !ok || now.After(e.expire) {
+		return nil, false
+	}
+
+	msg := e.msg
+	msg.ID = id
+	// keep the case of name in question
+	msg.Questions = []dnsmessage.Question{q}
+	elapsed := uint32(now.Sub(e.created) / time.Second)
+	msg.Answers = decreaseTTL(msg.Answers, elapsed)
+	msg.Authorities = decreaseTTL(msg.Authorities, elapsed)
+	msg.Additionals = decreaseTTL(msg.Additionals, elapsed)
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+func decreaseTTL(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(rrs) == 0 {
+		return rrs
+	}
+	res := make([]dnsmessage.Resource, len(rrs))
+	copy(res, rrs)
+	for i := range res {
+		// OPT pseudo-record uses the TTL field for flags
+		if res[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if res[i].Header.TTL > elapsed {
+			res[i].Header.TTL -= elapsed
+		} else {
+			res[i].Header.TTL = 0
+		}
+	}
+	return res
+}
+
+// set caches the response of question for the minimum TTL of records
+func (c *cache) set(q dnsmessage.Question, resp []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return
+	}
+	if msg.Truncated || (msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+
+	ttl := maxCacheTTL
+	if len(msg.Answers) == 0 && len(msg.Authorities) == 0 {
+		ttl = negativeCacheTTL
+	}
+	for _, rrs := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+		for _, rr := range rrs {
+			if d := time.Duration(rr.Header.TTL) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	q.Name = lowerName(q.Name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCacheSize {
+		for k, e := range c.entries {
+			if now.After(e.expire) {
+				delete(c.entries, k)
+			}
+		}
+		// still full, drop an arbitrary entry
+		if len(c.entries) >= maxCacheSize {
+			for k := range c.entries {
+				delete(c.entries, k)
+				break
+			}
+		}
+	}
+	c.entries[q] = cacheEntry{msg: msg, created: now, expire: now.Add(ttl)}
+}
+
+func lowerName(n dnsmessage.Name) dnsmessage.Name {
+	for i := 0; i < int(n.Length); i++ {
+		if b := n.Data[i]; 'A' <= b && b <= 'Z' {
+			n.Data[i] = b + 'a' - 'A'
+		}
+	}
+	return n
+}
@@ -0,0 +1,103 @@
+package dns
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+// FakeIPPool hands out IPv4 addresses from a reserved range to domain names,
+// and maps the addresses back to the names. When the pool runs out, the
+// address of the least recently used name is recycled.
+type FakeIPPool struct {
+	ipnet *net.IPNet
+	base  uint32 // the first usable address
+	size  uint32
+
+	mu     sync.Mutex
+	next   uint32     // offset of the next allocation before the pool runs out
+	lru    *list.List // of *fakeIP, the most recently used at front
+	byName map[string]*list.Element
+	byIP   map[uint32]*list.Element
+}
+
+type fakeIP struct {
+	name string
+	off  uint32
+}
+
+// NewFakeIPPool creates a pool of the IPv4 CIDR range, e.g. 198.18.0.0/15.
+// The network and broadcast addresses are not allocated.
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := ipnet.IP.To4()
+	ones, bits := ipnet.Mask.Size()
+	if ip4 == nil || bits != 32 {
+		return nil, errors.New("fake IP range must be IPv4")
+	}
+	if ones > 30 {
+		return nil, errors.New("fake IP range is too small")
+	}
+	return &FakeIPPool{
+		ipnet:  ipnet,
+		base:   binary.BigEndian.Uint32(ip4) + 1,
+		size:   1<<(32-ones) - 2,
+		lru:    list.New(),
+		byName: make(map[string]*list.Element),
+		byIP:   make(map[uint32]*list.Element),
+	}, nil
+}
+
+// Lookup returns the fake IP of name, allocating one if necessary
+func (p *FakeIPPool) Lookup(name string) net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var off uint32
+	if e, ok := p.byName[name]; ok {
+		p.lru.MoveToFront(e)
+		off = e.Value.(*fakeIP).off
+	} else {
+		if p.next < p.size {
+			off = p.next
+			p.next++
+		} else {
+			oldest := p.lru.Remove(p.lru.Back()).(*fakeIP)
+			delete(p.byName, oldest.name)
+			off = oldest.off
+		}
+		e := p.lru.PushFront(&fakeIP{name: name, off: off})
+		p.byName[name] = e
+		p.byIP[off] = e
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, p.base+off)
+	return ip
+}
+
+// Contains reports whether ip is in the range of pool
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	return p.ipnet.Contains(ip)
+}
+
+// Domain returns the name that fake IP was allocated to
+func (p *FakeIPPool) Domain(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !p.ipnet.Contains(ip4) {
+		return "", false
+	}
+	off := binary.BigEndian.Uint32(ip4) - p.base
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.byIP[off]
+	if !ok {
+		return "", false
+	}
+	// the name is still in use
+	p.lru.MoveToFront(e)
+	return e.Value.(*fakeIP).name, true
+}
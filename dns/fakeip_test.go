@@ -0,0 +1,57 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	if _, err := NewFakeIPPool("fc00::/64"); err == nil {
+		t.Error("expected error for IPv6 range")
+	}
+
+	// 6 usable addresses
+	p, err := NewFakeIPPool("198.18.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := p.Lookup("a.com")
+	if !ip.Equal(net.IPv4(198, 18, 0, 1)) {
+		t.Fatalf("got %s, want 198.18.0.1", ip)
+	}
+	if again := p.Lookup("a.com"); !again.Equal(ip) {
+		t.Fatalf("got %s for the same name, want %s", again, ip)
+	}
+	if name, ok := p.Domain(ip); !ok || name != "a.com" {
+		t.Fatalf("got %q, want a.com", name)
+	}
+	if _, ok := p.Domain(net.IPv4(198, 18, 0, 0)); ok {
+		t.Fatal("network address should not be allocated")
+	}
+
+	for _, name := range []string{"b.com", "c.com", "d.com", "e.com", "f.com"} {
+		p.Lookup(name)
+	}
+	// a.com is recycled
+	if ip := p.Lookup("g.com"); !ip.Equal(net.IPv4(198, 18, 0, 1)) {
+		t.Fatalf("got %s, want recycled 198.18.0.1", ip)
+	}
+	if name, _ := p.Domain(net.IPv4(198, 18, 0, 1)); name != "g.com" {
+		t.Fatalf("got %q, want g.com", name)
+	}
+	if ip := p.Lookup("a.com"); !ip.Equal(net.IPv4(198, 18, 0, 2)) {
+		t.Fatalf("got %s, want 198.18.0.2", ip)
+	}
+
+	// the name looked up again survives the recycling of others
+	p.Lookup("g.com")
+	for _, name := range []string{"h.com", "i.com", "j.com", "k.com", "l.com"} {
+		p.Lookup(name)
+	}
+	if ip := p.Lookup("g.com"); !ip.Equal(net.IPv4(198, 18, 0, 1)) {
+		t.Fatalf("got %s, want 198.18.0.1 kept by g.com", ip)
+	}
+	if _, ok := p.Domain(net.IPv4(198, 18, 0, 2)); !ok {
+		t.Fatal("want recycled 198.18.0.2 allocated")
+	}
+}
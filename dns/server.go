@@ -0,0 +1,417 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chenen3/yeager/logger"
+	"github.com/chenen3/yeager/transport"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Router decides how to resolve the domain name
+type Router interface {
+	// Route returns the dialer to reach the remote upstream, or nil if
+	// the name should be resolved by the local upstream. An error means
+	// the name is blocked.
+	Route(name string) (transport.Dialer, error)
+}
+
+// Server answers DNS queries over UDP and TCP. Queries are forwarded
+// to the remote upstream through the dialer using DNS-over-TCP,
+// or to the local upstream over UDP.
+type Server struct {
+	router        Router
+	upstream      string
+	localUpstream string
+	fakeIP        *FakeIPPool
+	cache         *cache
+	// limits the queries over UDP being handled
+	sem chan struct{}
+
+	mu         sync.Mutex
+	closed     bool
+	pc         net.PacketConn
+	lis        net.Listener
+	activeConn map[net.Conn]struct{}
+}
+
+const exchangeTimeout = 5 * time.Second
+
+// the maximum number of concurrent UDP queries,
+// more queries are dropped and left to client retry
+const maxUDPQueries = 256
+
+const defaultUpstream = "8.8.8.8:53"
+
+// the TTL of fake IP answer, short enough that clients
+// do not hold the address after it is recycled
+const fakeIPTTL = 60
+
+// NewServer returns a DNS server. The remote upstream is reached through the
+// dialer returned by router, and the local upstream is reached directly.
+// Upstream defaults to 8.8.8.8:53, and localUpstream defaults to upstream.
+// If fakeIP is not nil, the A queries of proxied names are answered with
+// addresses from the pool instead, and AAAA queries with empty answer.
+// The caller should call Close when finished.
+func NewServer(router Router, upstream, localUpstream string, fakeIP *FakeIPPool) *Server {
+	if upstream == "" {
+		upstream = defaultUpstream
+	}
+	if localUpstream == "" {
+		localUpstream = upstream
+	}
+	return &Server{
+		router:        router,
+		upstream:      upstream,
+		localUpstream: localUpstream,
+		fakeIP:        fakeIP,
+		cache:         newCache(),
+		sem:           make(chan struct{}, maxUDPQueries),
+	}
+}
+
+// ServePacket serves DNS over UDP,
+// blocking until the server closes or encounters an unexpected error.
+func (s *Server) ServePacket(pc net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return pc.Close()
+	}
+	s.pc = pc
+	s.mu.Unlock()
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+			return err
+		}
+		select {
+		case s.sem <- struct{}{}:
+		default:
+			logger.Debug.Printf("dns: drop query from %s, too many queries", addr)
+			continue
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			defer func() { <-s.sem }()
+			resp, err := s.handle(query)
+			if err != nil {
+				logger.Debug.Printf("dns: %s", err)
+				return
+			}
+			resp, err = truncate(resp, udpSize(query))
+			if err != nil {
+				logger.Debug.Printf("dns: %s", err)
+				return
+			}
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				logger.Debug.Printf("dns: %s", err)
+			}
+		}()
+	}
+}
+
+// Serve serves DNS over TCP,
+// blocking until the server closes or encounters an unexpected error.
+func (s *Server) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return lis.Close()
+	}
+	s.lis = lis
+	s.mu.Unlock()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+			return err
+		}
+		s.trackConn(conn, true)
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.trackConn(conn, false)
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		query, err := readMsg(conn)
+		if err != nil {
+			return
+		}
+		resp, err := s.handle(query)
+		if err != nil {
+			logger.Debug.Printf("dns: %s", err)
+			return
+		}
+		if err = writeMsg(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.activeConn == nil {
+		s.activeConn = make(map[net.Conn]struct{})
+	}
+	if add {
+		s.activeConn[c] = struct{}{}
+	} else {
+		delete(s.activeConn, c)
+	}
+}
+
+// Close closes the sockets being served, the sockets
+// passed to Serve and ServePacket later are closed as well
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	if s.pc != nil {
+		err = s.pc.Close()
+	}
+	if s.lis != nil {
+		if e := s.lis.Close(); e != nil {
+			err = e
+		}
+	}
+	for c := range s.activeConn {
+		c.Close()
+	}
+	return err
+}
+
+// handle answers the query message
+func (s *Server) handle(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return reply(header, nil, dnsmessage.RCodeFormatError)
+	}
+
+	if resp, ok := s.cache.get(q, header.ID); ok {
+		return resp, nil
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	dialer, err := s.router.Route(name)
+	if err != nil {
+		logger.Debug.Printf("dns: refuse %s: %s", name, err)
+		return reply(header, &q, dnsmessage.RCodeRefused)
+	}
+	if dialer != nil && s.fakeIP != nil && q.Class == dnsmessage.ClassINET {
+		switch q.Type {
+		case dnsmessage.TypeA:
+			ip := s.fakeIP.Lookup(name)
+			logger.Debug.Printf("dns: fake IP %s for %s", ip, name)
+			return replyA(header, q, ip)
+		case dnsmessage.TypeAAAA:
+			// let the client fallback to IPv4
+			return reply(header, &q, dnsmessage.RCodeSuccess)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exchangeTimeout)
+	defer cancel()
+	var resp []byte
+	if dialer == nil {
+		resp, err = exchangeUDP(ctx, s.localUpstream, query)
+	} else {
+		resp, err = exchangeTCP(ctx, dialer, s.upstream, query)
+	}
+	if err != nil {
+		logger.Debug.Printf("dns: resolve %s: %s", name, err)
+		return reply(header, &q, dnsmessage.RCodeServerFailure)
+	}
+	s.cache.set(q, resp)
+	return resp, nil
+}
+
+// the maximum size of UDP message without EDNS, see RFC 1035
+const maxUDPSize = 512
+
+// udpSize returns the maximum size of UDP response
+// that the client accepts, as advertised by EDNS
+func udpSize(query []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return maxUDPSize
+	}
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return maxUDPSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return maxUDPSize
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			// the class of OPT record is the UDP payload size
+			if size := int(h.Class); size > maxUDPSize {
+				return size
+			}
+			return maxUDPSize
+		}
+		if err = p.SkipAdditional(); err != nil {
+			return maxUDPSize
+		}
+	}
+}
+
+// truncate sets the TC bit of response exceeding size and removes
+// the records except OPT, so that the client retries over TCP
+func truncate(resp []byte, size int) ([]byte, error) {
+	if len(resp) <= size {
+		return resp, nil
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, err
+	}
+	msg.Truncated = true
+	msg.Answers = nil
+	msg.Authorities = nil
+	var opt []dnsmessage.Resource
+	for _, r := range msg.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			opt = append(opt, r)
+		}
+	}
+	msg.Additionals = opt
+	return msg.Pack()
+}
+
+// reply returns a response without answer
+func reply(query dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			OpCode:             query.OpCode,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+	}
+	if q != nil {
+		msg.Questions = []dnsmessage.Question{*q}
+	}
+	return msg.Pack()
+}
+
+// replyA returns a response with the A record
+func replyA(query dnsmessage.Header, q dnsmessage.Question, ip net.IP) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			OpCode:             query.OpCode,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+	var a dnsmessage.AResource
+	copy(a.A[:], ip.To4())
+	msg.Answers = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   fakeIPTTL,
+		},
+		Body: &a,
+	}}
+	return msg.Pack()
+}
+
+// exchangeTCP sends query to the upstream through dialer using DNS-over-TCP
+func exchangeTCP(ctx context.Context, dialer transport.Dialer, upstream string, query []byte) ([]byte, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err = writeMsg(conn, query); err != nil {
+		return nil, err
+	}
+	return readMsg(conn)
+}
+
+// exchangeUDP sends query to the upstream over UDP
+func exchangeUDP(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore the mismatched response
+		if n >= 2 && binary.BigEndian.Uint16(buf) == binary.BigEndian.Uint16(query) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// readMsg reads a length-prefixed message of DNS-over-TCP
+func readMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeMsg writes a length-prefixed message of DNS-over-TCP
+func writeMsg(w io.Writer, msg []byte) error {
+	if len(msg) > 0xffff {
+		return errors.New("message too long")
+	}
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,349 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chenen3/yeager/transport"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// upstream answers A queries with the fixed IP, over both UDP and TCP
+type upstream struct {
+	ip      [4]byte
+	records int // the number of A records in answer, defaults to 1
+	queries atomic.Int32
+	pc      net.PacketConn
+	lis     net.Listener
+}
+
+func newUpstream(t *testing.T, ip [4]byte) *upstream {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &upstream{ip: ip, pc: pc, lis: lis}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(u.answer(buf[:n]), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				query, err := readMsg(conn)
+				if err != nil {
+					return
+				}
+				writeMsg(conn, u.answer(query))
+			}()
+		}
+	}()
+	return u
+}
+
+func (u *upstream) answer(query []byte) []byte {
+	u.queries.Add(1)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil
+	}
+	msg.Response = true
+	msg.Answers = nil
+	for i := 0; i < max(u.records, 1); i++ {
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  msg.Questions[0].Name,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   60,
+			},
+			Body: &dnsmessage.AResource{A: u.ip},
+		})
+	}
+	b, _ := msg.Pack()
+	return b
+}
+
+func (u *upstream) Close() {
+	u.pc.Close()
+	u.lis.Close()
+}
+
+type testRouter map[string]transport.Dialer
+
+func (r testRouter) Route(name string) (transport.Dialer, error) {
+	d, ok := r[name]
+	if !ok {
+		return nil, errors.New("blocked")
+	}
+	return d, nil
+}
+
+func query(t *testing.T, network, addr, name string) *dnsmessage.Message {
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout(network, addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	var resp []byte
+	if network == "tcp" {
+		if err = writeMsg(conn, b); err != nil {
+			t.Fatal(err)
+		}
+		resp, err = readMsg(conn)
+	} else {
+		if _, err = conn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		resp = make([]byte, 512)
+		var n int
+		n, err = conn.Read(resp)
+		resp = resp[:n]
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err = msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	return &msg
+}
+
+func TestServer(t *testing.T) {
+	remote := newUpstream(t, [4]byte{1, 1, 1, 1})
+	defer remote.Close()
+	local := newUpstream(t, [4]byte{2, 2, 2, 2})
+	defer local.Close()
+
+	router := testRouter{
+		"proxied.com": new(net.Dialer),
+		"local.com":   nil,
+	}
+	s := NewServer(router, remote.lis.Addr().String(), local.pc.LocalAddr().String(), nil)
+	defer s.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServePacket(pc)
+	go s.Serve(lis)
+
+	tests := []struct {
+		network string
+		name    string
+		want    [4]byte
+	}{
+		{"udp", "proxied.com.", [4]byte{1, 1, 1, 1}},
+		{"tcp", "local.com.", [4]byte{2, 2, 2, 2}},
+		// cached
+		{"tcp", "Proxied.com.", [4]byte{1, 1, 1, 1}},
+		{"udp", "local.com.", [4]byte{2, 2, 2, 2}},
+	}
+	for _, tt := range tests {
+		msg := query(t, tt.network, pc.LocalAddr().String(), tt.name)
+		if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 1 {
+			t.Fatalf("query %s: unexpected response %v", tt.name, msg)
+		}
+		if msg.ID != 1 {
+			t.Errorf("query %s: got ID %d, want 1", tt.name, msg.ID)
+		}
+		got := msg.Answers[0].Body.(*dnsmessage.AResource).A
+		if got != tt.want {
+			t.Errorf("query %s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if n := remote.queries.Load() + local.queries.Load(); n != 2 {
+		t.Errorf("got %d upstream queries, want 2", n)
+	}
+
+	msg := query(t, "udp", pc.LocalAddr().String(), "blocked.com.")
+	if msg.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("got rcode %s, want %s", msg.RCode, dnsmessage.RCodeRefused)
+	}
+}
+
+func TestServerFakeIP(t *testing.T) {
+	local := newUpstream(t, [4]byte{2, 2, 2, 2})
+	defer local.Close()
+	pool, err := NewFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := testRouter{
+		"proxied.com": new(net.Dialer),
+		"local.com":   nil,
+	}
+	s := NewServer(router, "", local.pc.LocalAddr().String(), pool)
+	defer s.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServePacket(pc)
+
+	msg := query(t, "udp", pc.LocalAddr().String(), "proxied.com.")
+	if len(msg.Answers) != 1 {
+		t.Fatalf("unexpected response %v", msg)
+	}
+	ip := net.IP(msg.Answers[0].Body.(*dnsmessage.AResource).A[:])
+	if name, ok := pool.Domain(ip); !ok || name != "proxied.com" {
+		t.Errorf("got domain %q of fake IP %s, want proxied.com", name, ip)
+	}
+
+	msg = query(t, "udp", pc.LocalAddr().String(), "local.com.")
+	if len(msg.Answers) != 1 {
+		t.Fatalf("unexpected response %v", msg)
+	}
+	if got := msg.Answers[0].Body.(*dnsmessage.AResource).A; got != [4]byte{2, 2, 2, 2} {
+		t.Errorf("got %v, want real IP of local.com", got)
+	}
+}
+
+func TestServerTruncate(t *testing.T) {
+	remote := newUpstream(t, [4]byte{1, 1, 1, 1})
+	defer remote.Close()
+	// the response exceeds 512 bytes
+	remote.records = 40
+
+	s := NewServer(testRouter{"proxied.com": new(net.Dialer)}, remote.lis.Addr().String(), "", nil)
+	defer s.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServePacket(pc)
+	go s.Serve(lis)
+
+	msg := query(t, "udp", pc.LocalAddr().String(), "proxied.com.")
+	if !msg.Truncated || len(msg.Answers) != 0 {
+		t.Fatalf("got truncated %t with %d answers, want truncated without answer", msg.Truncated, len(msg.Answers))
+	}
+	msg = query(t, "tcp", pc.LocalAddr().String(), "proxied.com.")
+	if msg.Truncated || len(msg.Answers) != remote.records {
+		t.Fatalf("got truncated %t with %d answers over TCP, want %d answers", msg.Truncated, len(msg.Answers), remote.records)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s := NewServer(testRouter{}, "", "", nil)
+	s.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sockets served after Close are closed
+	if err = s.ServePacket(pc); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Serve(lis); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = pc.ReadFrom(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got error %v, want %v", err, net.ErrClosed)
+	}
+	if _, err = lis.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got error %v, want %v", err, net.ErrClosed)
+	}
+}
+
+// blockingDialer blocks the dial until released
+type blockingDialer struct {
+	dials   atomic.Int32
+	release chan struct{}
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dials.Add(1)
+	select {
+	case <-d.release:
+	case <-ctx.Done():
+	}
+	return nil, errors.New("unreachable")
+}
+
+func TestServerQueryLimit(t *testing.T) {
+	d := &blockingDialer{release: make(chan struct{})}
+	router := testRouter{}
+	for i := 0; i < 5; i++ {
+		router[fmt.Sprintf("%d.com", i)] = d
+	}
+	s := NewServer(router, "", "", nil)
+	defer s.Close()
+	s.sem = make(chan struct{}, 2)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServePacket(pc)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for name := range router {
+		q := dnsmessage.Message{Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name + "."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}}}
+		b, err := q.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(d.release)
+	if n := d.dials.Load(); n != 2 {
+		t.Fatalf("got %d concurrent queries, want 2", n)
+	}
+}
@@ -0,0 +1,51 @@
+package echo
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/chenen3/yeager/logger"
+)
+
+// UDPServer reads datagrams and writes them back to the sender.
+type UDPServer struct {
+	PacketConn net.PacketConn
+	running    sync.WaitGroup
+}
+
+func (s *UDPServer) Serve() {
+	s.running.Add(1)
+	defer s.running.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.PacketConn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error.Print(err)
+			}
+			return
+		}
+		if _, err := s.PacketConn.WriteTo(buf[:n], addr); err != nil {
+			logger.Error.Print(err)
+		}
+	}
+}
+
+func (s *UDPServer) Close() error {
+	err := s.PacketConn.Close()
+	s.running.Wait()
+	return err
+}
+
+// NewUDPServer starts a local UDP server for testing,
+// it sends back whatever it receives.
+func NewUDPServer() *UDPServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := UDPServer{PacketConn: pc}
+	go s.Serve()
+	return &s
+}
@@ -0,0 +1,43 @@
+package geo
+
+import (
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// IPDB looks up the country of IP address in MaxMind database.
+type IPDB struct {
+	reader *maxminddb.Reader
+}
+
+// OpenIPDB opens the MaxMind-format database file (mmdb).
+// The caller should call Close when finished.
+func OpenIPDB(path string) (*IPDB, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &IPDB{reader: r}, nil
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// Country returns the lower case ISO country code of ip,
+// or empty string if not found.
+func (db *IPDB) Country(ip net.IP) string {
+	var r countryRecord
+	if err := db.reader.Lookup(ip, &r); err != nil {
+		return ""
+	}
+	return strings.ToLower(r.Country.ISOCode)
+}
+
+func (db *IPDB) Close() error {
+	return db.reader.Close()
+}
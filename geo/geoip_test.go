@@ -0,0 +1,131 @@
+package geo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIPDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	err := writeMMDB(path, map[string]string{
+		"1.0.1.0/24":   "CN",
+		"8.8.8.0/24":   "US",
+		"10.10.0.0/16": "CN",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenIPDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.0.1.1", "cn"},
+		{"10.10.2.3", "cn"},
+		{"8.8.8.8", "us"},
+		{"9.9.9.9", ""},
+	}
+	for _, tt := range tests {
+		if got := db.Country(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Country(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// writeMMDB writes a minimal IPv4 MaxMind database that maps networks to country
+// codes. Refer to https://maxmind.github.io/MaxMind-DB/
+func writeMMDB(path string, countries map[string]string) error {
+	// trie of 32-bit keys, record value:
+	// -1 for empty, >=0 for node index, <= -2 for data index (-2-i)
+	nodes := [][2]int{{-1, -1}}
+	var data bytes.Buffer
+	var dataOffsets []int
+	for cidr, code := range countries {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		ones, _ := ipnet.Mask.Size()
+		ip := binary.BigEndian.Uint32(ipnet.IP.To4())
+
+		dataOffsets = append(dataOffsets, data.Len())
+		writeMap(&data, 1)
+		writeString(&data, "country")
+		writeMap(&data, 1)
+		writeString(&data, "iso_code")
+		writeString(&data, code)
+
+		n := 0
+		for i := 0; i < ones; i++ {
+			bit := (ip >> (31 - i)) & 1
+			if i == ones-1 {
+				nodes[n][bit] = -2 - (len(dataOffsets) - 1)
+				break
+			}
+			if nodes[n][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[n][bit] = len(nodes) - 1
+			}
+			n = nodes[n][bit]
+		}
+	}
+
+	var buf bytes.Buffer
+	nodeCount := len(nodes)
+	for _, node := range nodes {
+		for _, r := range node {
+			v := nodeCount
+			if r >= 0 {
+				v = r
+			} else if r <= -2 {
+				v = nodeCount + 16 + dataOffsets[-2-r]
+			}
+			buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	writeMap(&buf, 6)
+	writeString(&buf, "node_count")
+	writeUint(&buf, 6, uint64(nodeCount))
+	writeString(&buf, "record_size")
+	writeUint(&buf, 5, 24)
+	writeString(&buf, "ip_version")
+	writeUint(&buf, 5, 4)
+	writeString(&buf, "database_type")
+	writeString(&buf, "Test-Country")
+	writeString(&buf, "binary_format_major_version")
+	writeUint(&buf, 5, 2)
+	writeString(&buf, "binary_format_minor_version")
+	writeUint(&buf, 5, 0)
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+func writeMap(b *bytes.Buffer, size int) {
+	b.WriteByte(7<<5 | byte(size))
+}
+
+func writeString(b *bytes.Buffer, s string) {
+	b.WriteByte(2<<5 | byte(len(s)))
+	b.WriteString(s)
+}
+
+// writeUint writes unsigned integer of type 5 (uint16) or 6 (uint32)
+func writeUint(b *bytes.Buffer, typ byte, v uint64) {
+	var payload []byte
+	for ; v > 0; v >>= 8 {
+		payload = append([]byte{byte(v)}, payload...)
+	}
+	b.WriteByte(typ<<5 | byte(len(payload)))
+	b.Write(payload)
+}
@@ -0,0 +1,190 @@
+package geo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// SiteDB holds domain lists of v2ray-style geosite.dat,
+// which is a protobuf message as follows:
+//
+//	message GeoSiteList { repeated GeoSite entry = 1; }
+//	message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+//	message Domain { Type type = 1; string value = 2; }
+//	enum Type { Plain = 0; Regex = 1; Domain = 2; Full = 3; }
+type SiteDB struct {
+	// raw GeoSite messages by lower case code, decoded on demand
+	entries map[string][]byte
+}
+
+// OpenSiteDB reads the geosite.dat file
+func OpenSiteDB(path string) (*SiteDB, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSiteDB(bs)
+}
+
+func parseSiteDB(b []byte) (*SiteDB, error) {
+	db := &SiteDB{entries: make(map[string][]byte)}
+	err := rangeFields(b, func(num protowire.Number, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var code string
+		err := rangeFields(v, func(num protowire.Number, f []byte) error {
+			if num == 1 {
+				code = strings.ToLower(string(f))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		db.entries[code] = v
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parse geosite: %s", err)
+	}
+	return db, nil
+}
+
+// List returns the domain list of code, such as "google" or "cn"
+func (db *SiteDB) List(code string) (*DomainList, error) {
+	entry, ok := db.entries[strings.ToLower(code)]
+	if !ok {
+		return nil, errors.New("geosite code not found: " + code)
+	}
+
+	l := &DomainList{full: make(map[string]bool), suffix: make(map[string]bool)}
+	err := rangeFields(entry, func(num protowire.Number, v []byte) error {
+		if num != 2 {
+			return nil
+		}
+		var typ uint64
+		var value string
+		err := rangeFields(v, func(num protowire.Number, f []byte) error {
+			switch num {
+			case 1:
+				t, n := protowire.ConsumeVarint(f)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				typ = t
+			case 2:
+				value = string(f)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return l.add(typ, value)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parse geosite %s: %s", code, err)
+	}
+	return l, nil
+}
+
+// DomainList matches domain names in the list
+type DomainList struct {
+	full     map[string]bool
+	suffix   map[string]bool
+	keywords []string
+	regexps  []*regexp.Regexp
+}
+
+// domain types of geosite
+const (
+	typePlain = iota
+	typeRegex
+	typeDomain
+	typeFull
+)
+
+func (l *DomainList) add(typ uint64, value string) error {
+	switch typ {
+	case typePlain:
+		l.keywords = append(l.keywords, strings.ToLower(value))
+	case typeRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return err
+		}
+		l.regexps = append(l.regexps, re)
+	case typeDomain:
+		l.suffix[strings.ToLower(value)] = true
+	case typeFull:
+		l.full[strings.ToLower(value)] = true
+	}
+	return nil
+}
+
+// Match reports whether the lower case domain name is in the list
+func (l *DomainList) Match(domain string) bool {
+	if l.full[domain] {
+		return true
+	}
+	// check the domain and its parents, for example
+	// "a.b.com", "b.com", "com"
+	for s := domain; s != ""; {
+		if l.suffix[s] {
+			return true
+		}
+		_, s, _ = strings.Cut(s, ".")
+	}
+	for _, k := range l.keywords {
+		if strings.Contains(domain, k) {
+			return true
+		}
+	}
+	for _, re := range l.regexps {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeFields calls f for each length-delimited field of message b,
+// and for varint field with its encoded bytes.
+func rangeFields(b []byte, f func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v []byte
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			_, n = protowire.ConsumeVarint(b)
+			if n >= 0 {
+				v = b[:n]
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if v == nil {
+			continue
+		}
+		if err := f(num, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
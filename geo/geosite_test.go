@@ -0,0 +1,84 @@
+package geo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type testDomain struct {
+	typ   uint64
+	value string
+}
+
+func marshalGeoSite(sites map[string][]testDomain) []byte {
+	var list []byte
+	for code, domains := range sites {
+		var site []byte
+		site = protowire.AppendTag(site, 1, protowire.BytesType)
+		site = protowire.AppendString(site, code)
+		for _, d := range domains {
+			var domain []byte
+			if d.typ != 0 {
+				domain = protowire.AppendTag(domain, 1, protowire.VarintType)
+				domain = protowire.AppendVarint(domain, d.typ)
+			}
+			domain = protowire.AppendTag(domain, 2, protowire.BytesType)
+			domain = protowire.AppendString(domain, d.value)
+			site = protowire.AppendTag(site, 2, protowire.BytesType)
+			site = protowire.AppendBytes(site, domain)
+		}
+		list = protowire.AppendTag(list, 1, protowire.BytesType)
+		list = protowire.AppendBytes(list, site)
+	}
+	return list
+}
+
+func TestSiteDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geosite.dat")
+	bs := marshalGeoSite(map[string][]testDomain{
+		"GOOGLE": {
+			{typeDomain, "google.com"},
+			{typeFull, "www.gstatic.com"},
+			{typePlain, "youtube"},
+			{typeRegex, `^goo\.gl$`},
+		},
+		"CN": {{typeDomain, "cn"}},
+	})
+	if err := os.WriteFile(path, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenSiteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	google, err := db.List("google")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"google.com", true},
+		{"mail.google.com", true},
+		{"fakegoogle.com", false},
+		{"www.gstatic.com", true},
+		{"ssl.gstatic.com", false},
+		{"m.youtube.com", true},
+		{"goo.gl", true},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		if got := google.Match(tt.domain); got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+
+	if _, err := db.List("unknown"); err == nil {
+		t.Error("expected error for unknown code")
+	}
+}
@@ -0,0 +1,70 @@
+// Package netutil provides the helpers shared by proxies and transports.
+package netutil
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"sync"
+)
+
+// BasicAuth returns the value of Authorization or Proxy-Authorization
+// header for the HTTP Basic authentication.
+func BasicAuth(username, password string) string {
+	auth := username + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+}
+
+var bufPool = sync.Pool{
+	New: func() any {
+		// refer to 16KB maxPlaintext in crypto/tls/common.go
+		b := make([]byte, 16*1024)
+		return &b
+	},
+}
+
+// GetBuffer returns a 16KB buffer from pool,
+// the caller should call PutBuffer when finished.
+func GetBuffer() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+// PutBuffer returns the buffer to pool
+func PutBuffer(buf *[]byte) {
+	bufPool.Put(buf)
+}
+
+// Copy copies from src to dst until EOF using buffer from pool,
+// it is like io.Copy but does not use io.WriterTo or io.ReaderFrom.
+func Copy(dst io.Writer, src io.Reader) (written int64, err error) {
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+	for {
+		nr, er := src.Read(*buf)
+		if nr > 0 {
+			nw, ew := dst.Write((*buf)[0:nr])
+			if nw < 0 || nr < nw {
+				nw = 0
+				if ew == nil {
+					ew = errors.New("invalid write result")
+				}
+			}
+			written += int64(nw)
+			if ew != nil {
+				err = ew
+				break
+			}
+			if nr != nw {
+				err = io.ErrShortWrite
+				break
+			}
+		}
+		if er != nil {
+			if er != io.EOF {
+				err = er
+			}
+			break
+		}
+	}
+	return written, err
+}
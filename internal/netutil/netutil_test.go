@@ -0,0 +1,32 @@
+package netutil
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+	r, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", BasicAuth("user", "pass"))
+	username, password, ok := r.BasicAuth()
+	if !ok || username != "user" || password != "pass" {
+		t.Fatalf("got %q %q %t, want user pass", username, password, ok)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	want := strings.Repeat("a", 40*1024)
+	var dst bytes.Buffer
+	n, err := Copy(&dst, strings.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(want)) || dst.String() != want {
+		t.Fatalf("copied %d bytes, want %d", n, len(want))
+	}
+}
@@ -0,0 +1,91 @@
+// Package socksaddr implements the SOCKS address form, which is shared
+// by SOCKS5, Shadowsocks, Trojan and QUIC transport. Bytes order:
+//
+//	ATYP ADDR PORT
+//
+// Refer to https://datatracker.ietf.org/doc/html/rfc1928#section-5
+package socksaddr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// the address types
+const (
+	ATypIPv4   = 0x01
+	ATypDomain = 0x03
+	ATypIPv6   = 0x04
+)
+
+// MaxLen is the maximum size of SOCKS address in bytes.
+const MaxLen = 1 + 1 + 255 + 2
+
+// Append appends the SOCKS address form of addr to b
+func Append(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port: " + portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, ATypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, ATypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("domain name too long: " + host)
+		}
+		b = append(b, ATypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// Read reads the SOCKS address form from r
+func Read(r io.Reader) (string, error) {
+	var buf [255]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return "", err
+	}
+	var host string
+	switch buf[0] {
+	case ATypIPv4:
+		if _, err := io.ReadFull(r, buf[:net.IPv4len]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case ATypDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return "", err
+		}
+		n := buf[0]
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return "", err
+		}
+		host = string(buf[:n])
+	case ATypIPv6:
+		if _, err := io.ReadFull(r, buf[:net.IPv6len]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	default:
+		return "", fmt.Errorf("unknown address type: %x", buf[0])
+	}
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
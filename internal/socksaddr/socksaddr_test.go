@@ -0,0 +1,36 @@
+package socksaddr
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAppendRead(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:80", "[2001:db8::1]:443", "example.com:8080"} {
+		b, err := Append([]byte{0xff}, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0] != 0xff {
+			t.Fatalf("append %s: the prefix is overwritten", addr)
+		}
+		r := bytes.NewReader(b[1:])
+		got, err := Read(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != addr {
+			t.Errorf("got %s, want %s", got, addr)
+		}
+		if r.Len() != 0 {
+			t.Errorf("read %s: %d bytes left", addr, r.Len())
+		}
+	}
+
+	if _, err := Append(nil, "example.com:port"); err == nil {
+		t.Error("expected error for invalid port")
+	}
+	if _, err := Read(bytes.NewReader([]byte{0x02, 0, 0})); err == nil {
+		t.Error("expected error for unknown address type")
+	}
+}
@@ -0,0 +1,61 @@
+// Package transporttest provides the tests shared by transports.
+package transporttest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chenen3/yeager/echo"
+	"github.com/chenen3/yeager/transport"
+)
+
+// TestReverse asks the server of rl to listen on a local address,
+// and checks that the connections to it are streamed back to rl.
+func TestReverse(t *testing.T, rl transport.RemoteListener) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	remote, err := rl.Listen(ctx, "invalid address")
+	if err == nil {
+		remote.Close()
+		t.Fatal("expected error for invalid address")
+	}
+
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public.Close()
+	remote, err = rl.Listen(ctx, public.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := remote.Addr().String(); got != public.Addr().String() {
+		t.Errorf("got listener address %s, want %s", got, public.Addr())
+	}
+	// echo the connections accepted by server
+	es := echo.Server{Listener: remote}
+	go es.Serve()
+	defer es.Close()
+
+	conn, err := net.DialTimeout("tcp", public.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	want := []byte{1}
+	got := make([]byte, len(want))
+	if _, err := conn.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
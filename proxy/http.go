@@ -6,24 +6,47 @@ package proxy
 
 import (
 	"bufio"
+	"crypto/subtle"
 	"io"
 	"net/http"
+	"strings"
 
+	"github.com/chenen3/yeager/internal/netutil"
 	"github.com/chenen3/yeager/logger"
 	"github.com/chenen3/yeager/transport"
 )
 
 type httpHandler struct {
 	dialer transport.Dialer
+	auth   []byte
 }
 
 // NewHTTPHandler creates a http.Handler that acts as a web proxy
 // to reach the destination using the given dialer.
-func NewHTTPHandler(dialer transport.Dialer) *httpHandler {
-	return &httpHandler{dialer: dialer}
+// If username is not empty, requests must carry the Basic
+// Proxy-Authorization with the username and password.
+func NewHTTPHandler(dialer transport.Dialer, username, password string) *httpHandler {
+	h := &httpHandler{dialer: dialer}
+	if username != "" {
+		h.auth = []byte(netutil.BasicAuth(username, password))
+	}
+	return h
 }
 
 func (h *httpHandler) ServeHTTP(proxyResp http.ResponseWriter, proxyReq *http.Request) {
+	if len(h.auth) != 0 {
+		auth := proxyReq.Header.Get("Proxy-Authorization")
+		prefix := "Basic "
+		if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) ||
+			subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), h.auth[len(prefix):]) != 1 {
+			proxyResp.Header().Set("Proxy-Authenticate", `Basic realm="yeager"`)
+			proxyResp.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+	}
+	// hop-by-hop header, do not pass it to the destination
+	proxyReq.Header.Del("Proxy-Authorization")
+
 	if proxyReq.Method == http.MethodConnect {
 		h.serveHTTPConnect(proxyResp, proxyReq)
 		return
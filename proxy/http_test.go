@@ -22,7 +22,7 @@ func TestHttpProxy(t *testing.T) {
 		t.Fatal(err)
 	}
 	ready := make(chan struct{})
-	s := http.Server{Handler: NewHTTPHandler(&net.Dialer{})}
+	s := http.Server{Handler: NewHTTPHandler(&net.Dialer{}, "", "")}
 	defer s.Close()
 	go func() {
 		close(ready)
@@ -68,7 +68,7 @@ func TestHttpsProxy(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	s := http.Server{Handler: NewHTTPHandler(&net.Dialer{})}
+	s := http.Server{Handler: NewHTTPHandler(&net.Dialer{}, "", "")}
 	defer s.Close()
 	ready := make(chan struct{})
 	go func() {
@@ -100,3 +100,51 @@ func TestHttpsProxy(t *testing.T) {
 		t.Fatalf("got %s, want %s", got, want)
 	}
 }
+
+func TestHttpProxyAuth(t *testing.T) {
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization should not be forwarded")
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer httpSrv.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := http.Server{Handler: NewHTTPHandler(&net.Dialer{}, "u", "p")}
+	defer s.Close()
+	go s.Serve(lis)
+
+	tests := []struct {
+		name       string
+		user       *url.Userinfo
+		wantStatus int
+	}{
+		{name: "valid", user: url.UserPassword("u", "p"), wantStatus: http.StatusOK},
+		{name: "bad password", user: url.UserPassword("u", "x"), wantStatus: http.StatusProxyAuthRequired},
+		{name: "no auth", user: nil, wantStatus: http.StatusProxyAuthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyUrl := &url.URL{Scheme: "http", Host: lis.Addr().String(), User: tt.user}
+			client := &http.Client{
+				Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)},
+				Timeout:   time.Second,
+			}
+			res, err := client.Get(httpSrv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+			if res.StatusCode == http.StatusProxyAuthRequired && res.Header.Get("Proxy-Authenticate") == "" {
+				t.Fatal("missing Proxy-Authenticate header")
+			}
+		})
+	}
+}
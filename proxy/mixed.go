@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chenen3/yeager/logger"
+	"github.com/chenen3/yeager/transport"
+)
+
+// mixedServer serves SOCKS5 and HTTP proxy on the same listener,
+// by peeking the first byte of connection.
+type mixedServer struct {
+	socks   *socks5Server
+	http    *http.Server
+	httpLis *chanListener
+
+	mu     sync.Mutex
+	closed bool
+	lis    net.Listener
+	// the connections before handed over to SOCKS5 or HTTP server
+	activeConn map[net.Conn]struct{}
+}
+
+// NewMixedServer returns a new proxy server that serves both SOCKS5 and HTTP.
+// If username is not empty, clients of both protocols must authenticate
+// with the username and password. The caller should call Close when finished.
+func NewMixedServer(dialer transport.Dialer, username, password string) *mixedServer {
+	return &mixedServer{
+		socks: NewSOCKS5Server(dialer, username, password),
+		http:  &http.Server{Handler: NewHTTPHandler(dialer, username, password)},
+	}
+}
+
+// Serve serves connection accepted by lis,
+// blocking until the server closes or encounters an unexpected error.
+func (s *mixedServer) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	s.lis = lis
+	s.httpLis = newChanListener(lis.Addr())
+	s.mu.Unlock()
+	go func() {
+		err := s.http.Serve(s.httpLis)
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error.Printf("serve http: %s", err)
+		}
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+			return err
+		}
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			continue
+		}
+		go s.dispatch(conn)
+	}
+}
+
+// trackConn adds or removes the connection before handing over,
+// it reports false if adding to a closed server.
+func (s *mixedServer) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.activeConn == nil {
+		s.activeConn = make(map[net.Conn]struct{})
+	}
+	if add {
+		if s.closed {
+			return false
+		}
+		s.activeConn[c] = struct{}{}
+	} else {
+		delete(s.activeConn, c)
+	}
+	return true
+}
+
+// dispatch hands over the connection according to the first byte,
+// 0x04 and 0x05 are the version of SOCKS, anything else is treated as HTTP.
+func (s *mixedServer) dispatch(conn net.Conn) {
+	defer s.trackConn(conn, false)
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		logger.Debug.Printf("set read deadline: %s", err)
+		conn.Close()
+		return
+	}
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(1)
+	if err != nil {
+		logger.Debug.Printf("peek: %s", err)
+		conn.Close()
+		return
+	}
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		logger.Debug.Printf("set read deadline: %s", err)
+		conn.Close()
+		return
+	}
+
+	pc := &peekedConn{Conn: conn, r: br}
+	if b[0] == socks4Version || b[0] == socks5Version {
+		s.socks.trackConn(pc, true)
+		s.trackConn(conn, false)
+		s.socks.handleConn(pc)
+		return
+	}
+	// the connection is tracked until the HTTP server accepts it
+	if err := s.httpLis.push(pc); err != nil {
+		conn.Close()
+	}
+}
+
+func (s *mixedServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	if s.lis != nil {
+		err = s.lis.Close()
+	}
+	for c := range s.activeConn {
+		c.Close()
+	}
+	if e := s.http.Close(); e != nil {
+		err = e
+	}
+	if e := s.socks.Close(); e != nil {
+		err = e
+	}
+	return err
+}
+
+// peekedConn reads the buffered bytes before reading the connection
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("unsupported CloseWrite")
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// chanListener is a net.Listener that accepts the connections pushed to it
+type chanListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newChanListener(addr net.Addr) *chanListener {
+	return &chanListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *chanListener) push(c net.Conn) error {
+	select {
+	case l.conns <- c:
+		return nil
+	case <-l.done:
+		return net.ErrClosed
+	}
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return l.addr
+}
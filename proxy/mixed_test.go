@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMixedServer(t *testing.T) {
+	want := "ok"
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(want))
+	}))
+	defer httpSrv.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMixedServer(new(net.Dialer), "", "")
+	defer s.Close()
+	go s.Serve(lis)
+	// the proxy server may not started yet
+	time.Sleep(time.Millisecond)
+
+	for _, scheme := range []string{"http", "socks5"} {
+		u, err := url.Parse(scheme + "://" + lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(u)},
+			Timeout:   time.Second,
+		}
+		resp, err := client.Get(httpSrv.URL)
+		if err != nil {
+			t.Fatalf("%s: %s", scheme, err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %s, want %s", scheme, got, want)
+		}
+		client.CloseIdleConnections()
+	}
+}
+
+func TestMixedServerClose(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMixedServer(new(net.Dialer), "", "")
+	go s.Serve(lis)
+
+	// the connection is waiting for the first byte
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got error %v, want connection closed by server", err)
+	}
+}
@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -11,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/chenen3/yeager/internal/socksaddr"
 	"github.com/chenen3/yeager/logger"
 	"github.com/chenen3/yeager/transport"
 )
@@ -20,13 +23,18 @@ type socks5Server struct {
 	lis        net.Listener
 	activeConn map[net.Conn]struct{}
 	dialer     transport.Dialer
+	username   string
+	password   string
 }
 
-// NewSOCKS5Server returns a new SOCKS5 proxy server that intends
-// to be a local proxy and does not require authentication.
+// NewSOCKS5Server returns a new SOCKS5 proxy server.
+// If username is not empty, clients must authenticate with the
+// username and password, otherwise no authentication is required.
+// UDP ASSOCIATE is supported if the dialer implements transport.PacketDialer.
+// Legacy SOCKS4 and SOCKS4a CONNECT requests are accepted as well.
 // The call should call Close when finished.
-func NewSOCKS5Server(dialer transport.Dialer) *socks5Server {
-	return &socks5Server{dialer: dialer}
+func NewSOCKS5Server(dialer transport.Dialer, username, password string) *socks5Server {
+	return &socks5Server{dialer: dialer, username: username, password: password}
 }
 
 // Serve serves connection accepted by lis,
@@ -54,21 +62,49 @@ func (s *socks5Server) handleConn(proxyConn net.Conn) {
 	defer proxyConn.Close()
 
 	proxyConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	addr, err := handshake(proxyConn)
+	version, cmd, addr, err := handshake(proxyConn, s.username, s.password)
 	if err != nil {
 		logger.Error.Printf("handshake: %s", err)
 		return
 	}
 	proxyConn.SetReadDeadline(time.Time{})
 
+	if cmd == cmdUDPAssociate {
+		s.handleUDPAssociate(proxyConn)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	stream, err := s.dialer.DialContext(ctx, "tcp", addr)
+	stream, dialErr := s.dialer.DialContext(ctx, "tcp", addr)
+	if dialErr == nil {
+		defer stream.Close()
+	}
+
+	// reply the result of connecting
+	if version == socks4Version {
+		// reply VN CD DSTPORT DSTIP
+		cd := byte(socks4Granted)
+		if dialErr != nil {
+			cd = socks4Rejected
+		}
+		_, err = proxyConn.Write([]byte{0x00, cd, 0, 0, 0, 0, 0, 0})
+	} else {
+		// reply VER REP RSV ATYP BND.ADDR BND.PORT
+		rep := byte(repSucceeded)
+		if dialErr != nil {
+			rep = repServerFailure
+		}
+		_, err = proxyConn.Write([]byte{0x05, rep, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	}
+	if dialErr != nil {
+		logger.Error.Printf("connect %s: %s", addr, dialErr)
+		return
+	}
 	if err != nil {
-		logger.Error.Printf("connect %s: %s", addr, err)
+		logger.Error.Printf("reply: %s", err)
 		return
 	}
-	defer stream.Close()
 
 	err = transport.Relay(proxyConn, stream)
 	if err != nil {
@@ -102,107 +138,180 @@ func (s *socks5Server) Close() error {
 	return err
 }
 
-// maxAddrLen is the maximum size of SOCKS address in bytes.
-const maxAddrLen = 1 + 1 + 255 + 2
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+)
+
+// reply codes of SOCKS4
+const (
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
 
 const (
-	cmdConnect = 0x01
-	// cmdUDPAssociate = 0x03
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
 )
 
 const (
-	atypIPv4   = 0x01
-	atypDomain = 0x03
-	atypIPv6   = 0x04
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
 )
 
+const (
+	repSucceeded       = 0x00
+	repServerFailure   = 0x01
+	repCmdNotSupported = 0x07
+)
+
+// handshake reads the request of client, the caller is responsible
+// for replying to the request in the returned version of protocol.
+// If username is not empty, the client must authenticate with
+// username and password, which rejects SOCKS4 client.
 // Refer to https://datatracker.ietf.org/doc/html/rfc1928
-func handshake(rw io.ReadWriter) (addr string, err error) {
-	buf := [maxAddrLen]byte{}
-	// read VER, NMETHODS, METHODS
-	if _, err = io.ReadFull(rw, buf[:2]); err != nil {
-		return "", err
+func handshake(rw io.ReadWriter, username, password string) (version, cmd byte, addr string, err error) {
+	buf := [socksaddr.MaxLen]byte{}
+	if _, err = io.ReadFull(rw, buf[:1]); err != nil {
+		return 0, 0, "", err
+	}
+	switch version = buf[0]; version {
+	case socks4Version:
+		cmd, addr, err = handshake4(rw, username)
+		return version, cmd, addr, err
+	case socks5Version:
+	default:
+		return 0, 0, "", fmt.Errorf("unsupported verison number: %d", version)
 	}
-	if version := buf[0]; version != 0x05 {
-		return "", fmt.Errorf("unsupported verison number: %d", version)
+
+	// read NMETHODS, METHODS
+	if _, err = io.ReadFull(rw, buf[:1]); err != nil {
+		return 0, 0, "", err
 	}
-	nmethods := buf[1]
+	nmethods := buf[0]
 	if _, err = io.ReadFull(rw, buf[:nmethods]); err != nil {
-		return "", err
+		return 0, 0, "", err
 	}
 
-	// reply VER METHOD
-	// it is fine to reply no auth when serving locally
-	noAuth := []byte{0x05, 0x00}
-	if _, err = rw.Write(noAuth); err != nil {
-		return "", err
+	// reply VER METHOD, username/password is required if configured
+	method := byte(methodNoAuth)
+	if username != "" {
+		method = methodUserPass
+	}
+	if !bytes.Contains(buf[:nmethods], []byte{method}) {
+		rw.Write([]byte{0x05, methodNoAcceptable})
+		return 0, 0, "", fmt.Errorf("no acceptable method, want %x", method)
+	}
+	if _, err = rw.Write([]byte{0x05, method}); err != nil {
+		return 0, 0, "", err
 	}
+	if method == methodUserPass {
+		if err = authenticate(rw, username, password); err != nil {
+			return 0, 0, "", err
+		}
+	}
+
 	// read VER CMD RSV ATYP DST.ADDR DST.PORT
 	if _, err = io.ReadFull(rw, buf[:3]); err != nil {
-		return "", err
+		return 0, 0, "", err
 	}
 
-	if cmd := buf[1]; cmd != cmdConnect {
-		return "", fmt.Errorf("unsupported cmd: %x", cmd)
+	cmd = buf[1]
+	if cmd != cmdConnect && cmd != cmdUDPAssociate {
+		// reply VER REP RSV ATYP BND.ADDR BND.PORT
+		rw.Write([]byte{0x05, repCmdNotSupported, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return 0, 0, "", fmt.Errorf("unsupported cmd: %x", cmd)
 	}
 
-	addr, err = readSOCKSAddr(rw, buf[:])
+	addr, err = socksaddr.Read(rw)
 	if err != nil {
-		return "", err
+		return 0, 0, "", err
 	}
+	return version, cmd, addr, nil
+}
 
-	// reply VER REP RSV ATYP BND.ADDR BND.PORT
-	_, err = rw.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-	if err != nil {
-		return "", err
+// handshake4 reads the SOCKS4 or SOCKS4a request after the version number,
+// the USERID is ignored unless username is not empty.
+// Refer to https://www.openssh.com/txt/socks4.protocol
+// and https://www.openssh.com/txt/socks4a.protocol
+func handshake4(rw io.ReadWriter, username string) (cmd byte, addr string, err error) {
+	// read CD DSTPORT DSTIP USERID NULL
+	buf := make([]byte, 7)
+	if _, err = io.ReadFull(rw, buf); err != nil {
+		return 0, "", err
+	}
+	cmd = buf[0]
+	port := binary.BigEndian.Uint16(buf[1:3])
+	ip := net.IPv4(buf[3], buf[4], buf[5], buf[6])
+	if _, err = readNullString(rw); err != nil {
+		return 0, "", err
+	}
+	host := ip.String()
+	// SOCKS4a: DSTIP 0.0.0.x with nonzero x, followed by domain name
+	if buf[3] == 0 && buf[4] == 0 && buf[5] == 0 && buf[6] != 0 {
+		if host, err = readNullString(rw); err != nil {
+			return 0, "", err
+		}
 	}
 
-	return addr, nil
+	if cmd != cmdConnect {
+		rw.Write([]byte{0x00, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		return 0, "", fmt.Errorf("unsupported cmd: %x", cmd)
+	}
+	// SOCKS4 carries no password, nothing to authenticate
+	if username != "" {
+		rw.Write([]byte{0x00, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		return 0, "", errors.New("authentication required for SOCKS4")
+	}
+	return cmd, net.JoinHostPort(host, strconv.Itoa(int(port))), nil
 }
 
-// read SOCKS address from r
-// bytes order:
-//
-//	ATYP BND.ADDR BND.PORT
-func readSOCKSAddr(r io.Reader, buf []byte) (addr string, err error) {
-	if len(buf) < maxAddrLen {
-		return "", errors.New("short buffer")
-	}
-	if _, err = io.ReadFull(r, buf[:1]); err != nil {
-		return "", err
-	}
-
-	var (
-		atyp = buf[0]
-		host string
-	)
-	switch atyp {
-	case atypIPv4:
-		if _, err = io.ReadFull(r, buf[:net.IPv4len]); err != nil {
+// readNullString reads a null-terminated string up to 255 bytes
+func readNullString(r io.Reader) (string, error) {
+	var b [256]byte
+	for i := range b {
+		if _, err := io.ReadFull(r, b[i:i+1]); err != nil {
 			return "", err
 		}
-		host = net.IPv4(buf[0], buf[1], buf[2], buf[3]).String()
-	case atypDomain:
-		if _, err = io.ReadFull(r, buf[:1]); err != nil {
-			return "", err
+		if b[i] == 0 {
+			return string(b[:i]), nil
 		}
-		domainLen := buf[0]
-		if _, err = io.ReadFull(r, buf[:domainLen]); err != nil {
-			return "", err
-		}
-		host = string(buf[:domainLen])
-	case atypIPv6:
-		if _, err = io.ReadFull(r, buf[:net.IPv6len]); err != nil {
-			return "", err
-		}
-		ipv6 := make(net.IP, net.IPv6len)
-		copy(ipv6, buf[:net.IPv6len])
-		host = ipv6.String()
 	}
+	return "", errors.New("string too long")
+}
 
-	if _, err = io.ReadFull(r, buf[:2]); err != nil {
-		return "", err
+// authenticate performs username/password sub-negotiation.
+// Refer to https://datatracker.ietf.org/doc/html/rfc1929
+func authenticate(rw io.ReadWriter, username, password string) error {
+	buf := make([]byte, 255)
+	// read VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return err
+	}
+	if version := buf[0]; version != 0x01 {
+		return fmt.Errorf("unsupported auth version: %d", version)
+	}
+	ulen := buf[1]
+	if _, err := io.ReadFull(rw, buf[:ulen]); err != nil {
+		return err
 	}
-	port := binary.BigEndian.Uint16(buf[:2])
-	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+	uname := string(buf[:ulen])
+	if _, err := io.ReadFull(rw, buf[:1]); err != nil {
+		return err
+	}
+	plen := buf[0]
+	if _, err := io.ReadFull(rw, buf[:plen]); err != nil {
+		return err
+	}
+	passwd := string(buf[:plen])
+
+	// reply VER STATUS
+	if subtle.ConstantTimeCompare([]byte(uname), []byte(username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(passwd), []byte(password)) != 1 {
+		rw.Write([]byte{0x01, 0x01})
+		return errors.New("invalid username or password")
+	}
+	_, err := rw.Write([]byte{0x01, 0x00})
+	return err
 }
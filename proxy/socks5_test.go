@@ -1,13 +1,18 @@
 package proxy
 
 import (
+	"context"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"testing"
 	"time"
+
+	"github.com/chenen3/yeager/echo"
+	"github.com/chenen3/yeager/internal/socksaddr"
 )
 
 func TestSocksProxy(t *testing.T) {
@@ -22,7 +27,7 @@ func TestSocksProxy(t *testing.T) {
 		t.Fatal(err)
 	}
 	ready := make(chan struct{})
-	s := NewSOCKS5Server(new(net.Dialer))
+	s := NewSOCKS5Server(new(net.Dialer), "", "")
 	defer s.Close()
 	go func() {
 		close(ready)
@@ -61,3 +66,198 @@ func TestSocksProxy(t *testing.T) {
 		t.Fatalf("got %s, want %s", got, want)
 	}
 }
+
+func TestSocksProxyAuth(t *testing.T) {
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer httpSrv.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSOCKS5Server(new(net.Dialer), "u", "p")
+	defer s.Close()
+	go s.Serve(lis)
+
+	tests := []struct {
+		name    string
+		user    *url.Userinfo
+		wantErr bool
+	}{
+		{name: "valid", user: url.UserPassword("u", "p")},
+		{name: "bad password", user: url.UserPassword("u", "x"), wantErr: true},
+		{name: "no auth", user: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &url.URL{Scheme: "socks5", Host: lis.Addr().String(), User: tt.user}
+			client := &http.Client{
+				Transport: &http.Transport{Proxy: http.ProxyURL(u)},
+				Timeout:   time.Second,
+			}
+			resp, err := client.Get(httpSrv.URL)
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Errorf("bad status: %s", resp.Status)
+			}
+		})
+	}
+}
+
+// directDialer connects to destination directly, including UDP
+type directDialer struct {
+	net.Dialer
+}
+
+func (d *directDialer) DialPacket(ctx context.Context, addr string) (net.Conn, error) {
+	return d.DialContext(ctx, "udp", addr)
+}
+
+func TestSocksUDPAssociate(t *testing.T) {
+	es := echo.NewUDPServer()
+	defer es.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSOCKS5Server(new(directDialer), "", "")
+	defer s.Close()
+	go s.Serve(lis)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	// VER NMETHODS METHODS, then VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := []byte{0x05, 0x01, 0x00, 0x05, cmdUDPAssociate, 0x00, socksaddr.ATypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	var buf [5]byte
+	if _, err = io.ReadFull(conn, buf[:5]); err != nil {
+		t.Fatal(err)
+	}
+	if rep := buf[3]; rep != repSucceeded {
+		t.Fatalf("got reply %d, want %d", rep, repSucceeded)
+	}
+	relayAddr, err := socksaddr.Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := net.Dial("udp", relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(time.Second))
+	header, err := socksaddr.Append([]byte{0, 0, 0}, es.PacketConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("ping")
+	if _, err = pc.Write(append(header, want...)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 1024)
+	n, err := pc.Read(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, data, err := parseUDPHeader(got[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != es.PacketConn.LocalAddr().String() {
+		t.Errorf("got address %s, want %s", addr, es.PacketConn.LocalAddr())
+	}
+	if string(data) != string(want) {
+		t.Fatalf("got %s, want %s", data, want)
+	}
+}
+
+func TestSocks4Proxy(t *testing.T) {
+	es := echo.NewServer()
+	defer es.Close()
+	host, portStr, err := net.SplitHostPort(es.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSOCKS5Server(new(net.Dialer), "", "")
+	defer s.Close()
+	go s.Serve(lis)
+	// the proxy server may not started yet
+	time.Sleep(time.Millisecond)
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+
+	ip := net.ParseIP(host).To4()
+	tests := []struct {
+		name string
+		req  []byte
+		want byte
+	}{
+		{"socks4", append([]byte{0x04, cmdConnect, byte(port >> 8), byte(port), ip[0], ip[1], ip[2], ip[3]}, "user\x00"...), socks4Granted},
+		{"socks4a", append([]byte{0x04, cmdConnect, byte(port >> 8), byte(port), 0, 0, 0, 1}, "user\x00localhost\x00"...), socks4Granted},
+		{"unreachable", append([]byte{0x04, cmdConnect, byte(closedPort >> 8), byte(closedPort), ip[0], ip[1], ip[2], ip[3]}, "user\x00"...), socks4Rejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.DialTimeout("tcp", lis.Addr().String(), time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			if _, err = conn.Write(tt.req); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, 8)
+			if _, err = io.ReadFull(conn, reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply[1] != tt.want {
+				t.Fatalf("got reply code %x, want %x", reply[1], tt.want)
+			}
+			if tt.want != socks4Granted {
+				return
+			}
+			if _, err = conn.Write([]byte("1")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 1)
+			if _, err = io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "1" {
+				t.Fatalf("got %q, want %q", got, "1")
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chenen3/yeager/internal/socksaddr"
+	"github.com/chenen3/yeager/logger"
+	"github.com/chenen3/yeager/transport"
+)
+
+// udpIdleTimeout is how long a UDP session lives without any traffic
+const udpIdleTimeout = 2 * time.Minute
+
+// maxDatagramSize is large enough for any UDP payload
+const maxDatagramSize = 64 * 1024
+
+// handleUDPAssociate serves the UDP ASSOCIATE command. It opens a relay socket
+// which lives as long as the TCP connection of the request.
+func (s *socks5Server) handleUDPAssociate(proxyConn net.Conn) {
+	dialer, ok := s.dialer.(transport.PacketDialer)
+	if !ok {
+		proxyConn.Write([]byte{0x05, repCmdNotSupported, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		logger.Error.Print("udp associate: dialer does not support UDP")
+		return
+	}
+
+	host, _, err := net.SplitHostPort(proxyConn.LocalAddr().String())
+	if err != nil {
+		logger.Error.Print(err)
+		return
+	}
+	relayConn, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		proxyConn.Write([]byte{0x05, repServerFailure, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		logger.Error.Printf("listen udp: %s", err)
+		return
+	}
+	defer relayConn.Close()
+
+	// reply VER REP RSV ATYP BND.ADDR BND.PORT
+	reply, err := socksaddr.Append([]byte{0x05, repSucceeded, 0x00}, relayConn.LocalAddr().String())
+	if err != nil {
+		logger.Error.Print(err)
+		return
+	}
+	if _, err = proxyConn.Write(reply); err != nil {
+		logger.Error.Printf("reply: %s", err)
+		return
+	}
+
+	a := &udpAssociation{
+		relayConn: relayConn,
+		dialer:    dialer,
+		sessions:  make(map[string]net.Conn),
+	}
+	if tcpAddr, ok := proxyConn.RemoteAddr().(*net.TCPAddr); ok {
+		a.clientIP = tcpAddr.IP
+	}
+	go func() {
+		// the association terminates when the TCP connection closes
+		io.Copy(io.Discard, proxyConn)
+		relayConn.Close()
+	}()
+	a.serve()
+}
+
+// udpAssociation relays datagrams between the SOCKS client and
+// the destinations, one session per destination address.
+type udpAssociation struct {
+	relayConn net.PacketConn
+	dialer    transport.PacketDialer
+	clientIP  net.IP
+
+	mu         sync.Mutex
+	clientAddr net.Addr
+	sessions   map[string]net.Conn
+}
+
+func (a *udpAssociation) serve() {
+	defer a.closeSessions()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, src, err := a.relayConn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error.Printf("read udp: %s", err)
+			}
+			return
+		}
+		// drop datagrams not coming from the client
+		if a.clientIP != nil && !a.clientIP.IsUnspecified() {
+			if u, ok := src.(*net.UDPAddr); ok && !u.IP.Equal(a.clientIP) {
+				continue
+			}
+		}
+		a.mu.Lock()
+		a.clientAddr = src
+		a.mu.Unlock()
+
+		dst, payload, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			logger.Debug.Printf("parse udp header: %s", err)
+			continue
+		}
+		conn, err := a.session(dst)
+		if err != nil {
+			logger.Error.Printf("connect %s: %s", dst, err)
+			continue
+		}
+		if _, err = conn.Write(payload); err != nil {
+			logger.Debug.Printf("write udp: %s", err)
+		}
+	}
+}
+
+// session returns the connection to dst, dialing a new one if necessary
+func (a *udpAssociation) session(dst string) (net.Conn, error) {
+	a.mu.Lock()
+	conn, ok := a.sessions[dst]
+	a.mu.Unlock()
+	if ok {
+		return conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := a.dialer.DialPacket(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	a.sessions[dst] = conn
+	a.mu.Unlock()
+	logger.Debug.Printf("udp session to %s", dst)
+	go a.copyBack(dst, conn)
+	return conn, nil
+}
+
+// copyBack sends datagrams received from dst to the client
+func (a *udpAssociation) copyBack(dst string, conn net.Conn) {
+	defer func() {
+		a.mu.Lock()
+		delete(a.sessions, dst)
+		a.mu.Unlock()
+		conn.Close()
+	}()
+
+	// the reply has the same header as request: RSV FRAG ATYP DST.ADDR DST.PORT
+	header, err := socksaddr.Append([]byte{0x00, 0x00, 0x00}, dst)
+	if err != nil {
+		logger.Error.Print(err)
+		return
+	}
+	buf := make([]byte, len(header)+maxDatagramSize)
+	copy(buf, header)
+	idle := time.AfterFunc(udpIdleTimeout, func() { conn.Close() })
+	defer idle.Stop()
+	for {
+		n, err := conn.Read(buf[len(header):])
+		if err != nil {
+			return
+		}
+		idle.Reset(udpIdleTimeout)
+		a.mu.Lock()
+		clientAddr := a.clientAddr
+		a.mu.Unlock()
+		if _, err = a.relayConn.WriteTo(buf[:len(header)+n], clientAddr); err != nil {
+			return
+		}
+	}
+}
+
+func (a *udpAssociation) closeSessions() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, conn := range a.sessions {
+		conn.Close()
+	}
+}
+
+// parseUDPHeader splits the SOCKS5 UDP request into destination address and data.
+// bytes order:
+//
+//	RSV FRAG ATYP DST.ADDR DST.PORT DATA
+func parseUDPHeader(b []byte) (addr string, data []byte, err error) {
+	if len(b) < 3 {
+		return "", nil, errors.New("short datagram")
+	}
+	// fragmentation is not supported
+	if frag := b[2]; frag != 0 {
+		return "", nil, errors.New("fragmented datagram")
+	}
+	r := bytes.NewReader(b[3:])
+	addr, err = socksaddr.Read(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return addr, b[len(b)-r.Len():], nil
+}
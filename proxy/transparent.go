@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chenen3/yeager/logger"
+	"github.com/chenen3/yeager/transport"
+)
+
+// transparentServer proxies connections that are intercepted by firewall,
+// such as iptables REDIRECT and TPROXY target, whose original destination
+// is recovered by origDst. It also serves as port forwarding to fixed target.
+type transparentServer struct {
+	mu         sync.Mutex
+	lis        net.Listener
+	activeConn map[net.Conn]struct{}
+	dialer     transport.Dialer
+	name       string // for logging
+	origDst    func(net.Conn) (string, error)
+}
+
+// NewRedirectServer returns a transparent proxy server for connections
+// redirected by iptables REDIRECT target, which recovers the original
+// destination through socket option SO_ORIGINAL_DST. Linux only.
+// The caller should call Close when finished.
+func NewRedirectServer(dialer transport.Dialer) *transparentServer {
+	return &transparentServer{dialer: dialer, name: "redirect", origDst: originalDst}
+}
+
+// NewTProxyServer returns a transparent proxy server for connections
+// diverted by iptables TPROXY target, the listener must be created
+// by ListenTProxy. The caller should call Close when finished.
+func NewTProxyServer(dialer transport.Dialer) *transparentServer {
+	return &transparentServer{
+		dialer: dialer,
+		name:   "tproxy",
+		origDst: func(c net.Conn) (string, error) {
+			// the socket is bound to the original destination
+			return c.LocalAddr().String(), nil
+		},
+	}
+}
+
+// NewForwardServer returns a server that forwards every connection
+// to the target address. The caller should call Close when finished.
+func NewForwardServer(dialer transport.Dialer, target string) *transparentServer {
+	return &transparentServer{
+		dialer: dialer,
+		name:   "forward",
+		origDst: func(net.Conn) (string, error) {
+			return target, nil
+		},
+	}
+}
+
+// Serve serves connection accepted by lis,
+// blocking until the server closes or encounters an unexpected error.
+func (s *transparentServer) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	s.lis = lis
+	s.mu.Unlock()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+			return err
+		}
+
+		s.trackConn(conn, true)
+		go s.handleConn(conn)
+	}
+}
+
+func (s *transparentServer) handleConn(conn net.Conn) {
+	defer s.trackConn(conn, false)
+	defer conn.Close()
+
+	addr, err := s.origDst(conn)
+	if err != nil {
+		logger.Error.Printf("%s: original destination: %s", s.name, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := s.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		logger.Error.Printf("connect %s: %s", addr, err)
+		return
+	}
+	defer stream.Close()
+
+	err = transport.Relay(conn, stream)
+	if err != nil {
+		logger.Debug.Printf("relay: %s", err)
+	}
+}
+
+func (s *transparentServer) trackConn(c net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.activeConn == nil {
+		s.activeConn = make(map[net.Conn]struct{})
+	}
+	if add {
+		s.activeConn[c] = struct{}{}
+	} else {
+		delete(s.activeConn, c)
+	}
+}
+
+func (s *transparentServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.lis != nil {
+		err = s.lis.Close()
+	}
+	for c := range s.activeConn {
+		c.Close()
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// defined in linux/netfilter_ipv6/ip6_tables.h
+const ip6tSOOriginalDst = 80
+
+// originalDst returns the destination of connection
+// before it was redirected by iptables REDIRECT target
+func originalDst(conn net.Conn) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	laddr, _ := tc.LocalAddr().(*net.TCPAddr)
+	var addr string
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if laddr != nil && laddr.IP.To4() != nil {
+			// struct sockaddr_in, the port and address are in network byte order
+			mreq, e := unix.GetsockoptIPv6Mreq(int(fd), unix.IPPROTO_IP, unix.SO_ORIGINAL_DST)
+			if e != nil {
+				serr = e
+				return
+			}
+			b := mreq.Multiaddr
+			port := binary.BigEndian.Uint16(b[2:4])
+			addr = net.JoinHostPort(net.IP(b[4:8]).String(), strconv.Itoa(int(port)))
+			return
+		}
+		info, e := unix.GetsockoptIPv6MTUInfo(int(fd), unix.IPPROTO_IPV6, ip6tSOOriginalDst)
+		if e != nil {
+			serr = e
+			return
+		}
+		var p [2]byte
+		binary.NativeEndian.PutUint16(p[:], info.Addr.Port)
+		port := binary.BigEndian.Uint16(p[:])
+		addr = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port)))
+	})
+	if err != nil {
+		return "", err
+	}
+	if serr != nil {
+		return "", serr
+	}
+	return addr, nil
+}
+
+// ListenTProxy announces on the local address with socket option
+// IP_TRANSPARENT, for accepting connections diverted by iptables
+// TPROXY target. It requires CAP_NET_ADMIN capability.
+func ListenTProxy(address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				if serr == nil && network == "tcp6" {
+					serr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxy is only supported on Linux")
+
+func originalDst(conn net.Conn) (string, error) {
+	return "", errTransparentUnsupported
+}
+
+func ListenTProxy(address string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
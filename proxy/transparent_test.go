@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chenen3/yeager/echo"
+)
+
+func TestTransparentServer(t *testing.T) {
+	es := echo.NewServer()
+	defer es.Close()
+	target := es.Listener.Addr().String()
+
+	tests := []struct {
+		name      string
+		newServer func() *transparentServer
+	}{
+		{"redirect", func() *transparentServer {
+			s := NewRedirectServer(new(net.Dialer))
+			// pretend the connection was redirected from echo server
+			s.origDst = func(net.Conn) (string, error) {
+				return target, nil
+			}
+			return s
+		}},
+		{"forward", func() *transparentServer {
+			return NewForwardServer(new(net.Dialer), target)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := tt.newServer()
+			defer s.Close()
+			go s.Serve(lis)
+
+			conn, err := net.DialTimeout("tcp", lis.Addr().String(), time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			want := "1"
+			if _, err = conn.Write([]byte(want)); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(want))
+			if _, err = io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
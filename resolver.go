@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chenen3/yeager/logger"
+)
+
+const (
+	resolveTimeout  = 2 * time.Second
+	resolveCacheTTL = 5 * time.Minute
+	// a failed lookup will be retried sooner
+	resolveFailureTTL = 30 * time.Second
+
+	maxResolveCacheSize = 4096
+)
+
+// resolver looks up IP addresses of host using the local resolver,
+// caching the results.
+type resolver struct {
+	lookup func(ctx context.Context, host string) ([]net.IP, error)
+
+	mu    sync.Mutex
+	cache map[string]resolveResult
+}
+
+type resolveResult struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+func newResolver() *resolver {
+	return &resolver{
+		lookup: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+		cache: make(map[string]resolveResult),
+	}
+}
+
+// resolve returns the IP addresses of host, or nil if the lookup failed
+func (r *resolver) resolve(host string) []net.IP {
+	now := time.Now()
+	r.mu.Lock()
+	res, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && now.Before(res.expire) {
+		return res.ips
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := r.lookup(ctx, host)
+	res = resolveResult{ips: ips, expire: now.Add(resolveCacheTTL)}
+	if err != nil {
+		logger.Debug.Printf("resolve %s: %s", host, err)
+		res = resolveResult{expire: now.Add(resolveFailureTTL)}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// evict expired entries to bound the cache
+	if len(r.cache) >= maxResolveCacheSize {
+		for k, v := range r.cache {
+			if now.After(v.expire) {
+				delete(r.cache, k)
+			}
+		}
+		// still full, drop an arbitrary entry
+		if len(r.cache) >= maxResolveCacheSize {
+			for k := range r.cache {
+				delete(r.cache, k)
+				break
+			}
+		}
+	}
+	r.cache[host] = res
+	return res.ips
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chenen3/yeager/logger"
+	"github.com/chenen3/yeager/proxy"
+	"github.com/chenen3/yeager/transport"
+)
+
+// reverseTunnel keeps a remote listener on the server,
+// and forwards the connections accepted by server to target.
+// It listens again if the remote listener is broken.
+type reverseTunnel struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	server interface{ Close() error }
+}
+
+const maxReverseRetryDelay = 30 * time.Second
+
+func startReverse(rl transport.RemoteListener, remote, target string) *reverseTunnel {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &reverseTunnel{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(t.done)
+		delay := time.Second
+		for {
+			if t.serve(rl, remote, target) {
+				delay = time.Second
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxReverseRetryDelay {
+				delay = maxReverseRetryDelay
+			}
+		}
+	}()
+	return t
+}
+
+// serve blocks until the remote listener is closed or broken,
+// it reports whether the server has listened.
+func (t *reverseTunnel) serve(rl transport.RemoteListener, remote, target string) bool {
+	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Second)
+	lis, err := rl.Listen(ctx, remote)
+	cancel()
+	if err != nil {
+		logger.Error.Printf("reverse tunnel listen on %s: %s", remote, err)
+		return false
+	}
+	s := proxy.NewForwardServer(new(net.Dialer), target)
+	t.mu.Lock()
+	if t.ctx.Err() != nil {
+		t.mu.Unlock()
+		lis.Close()
+		return true
+	}
+	t.server = s
+	t.mu.Unlock()
+	if err = s.Serve(lis); err != nil {
+		logger.Error.Printf("reverse tunnel %s: %s", remote, err)
+	}
+	s.Close()
+	return true
+}
+
+func (t *reverseTunnel) Close() error {
+	t.mu.Lock()
+	t.cancel()
+	if t.server != nil {
+		t.server.Close()
+	}
+	t.mu.Unlock()
+	<-t.done
+	return nil
+}
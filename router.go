@@ -0,0 +1,791 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/chenen3/yeager/config"
+	"github.com/chenen3/yeager/dns"
+	"github.com/chenen3/yeager/geo"
+	"github.com/chenen3/yeager/logger"
+	"github.com/chenen3/yeager/transport"
+)
+
+// built-in actions of routing rule
+const (
+	actionDirect = "direct"
+	actionReject = "reject"
+	actionProxy  = "proxy"
+)
+
+// router dispatches connections to outbound dialers according to rules
+type router struct {
+	rules      []rule
+	outbounds  map[string]transport.Dialer
+	transports []transport.Dialer
+	groups     []*dialerGroup
+	geo        *geoLoader
+	resolver   *resolver // resolves domain for IP rules if not nil
+	fakeIPs    map[string]*dns.FakeIPPool
+}
+
+// newRouter creates a router from the given config.
+// The caller should call Close when finished.
+func newRouter(cfg config.Config) (_ *router, err error) {
+	r := &router{outbounds: map[string]transport.Dialer{actionDirect: new(directDialer)}}
+	defer func() {
+		if err != nil {
+			r.Close()
+		}
+	}()
+
+	var all []namedDialer
+	named := make(map[string]namedDialer)
+	for _, t := range cfg.Transport {
+		var base transport.Dialer
+		if t.Via != "" {
+			// the preceding hop must be declared before, which rules out cycles
+			via, ok := named[t.Via]
+			if !ok {
+				return nil, fmt.Errorf("transport %s: unknown via transport %s", t.Name, t.Via)
+			}
+			base = via.Dialer
+		}
+		d, err := newStreamDialer(t, base)
+		if err != nil {
+			return nil, err
+		}
+		r.transports = append(r.transports, d)
+		nd := namedDialer{name: t.Name, Dialer: d}
+		if t.Name == "" {
+			nd.name = t.Protocol + " " + t.Address
+		} else {
+			if isBuiltinAction(t.Name) || named[t.Name].Dialer != nil {
+				return nil, errors.New("duplicated transport name: " + t.Name)
+			}
+			named[t.Name] = nd
+			r.outbounds[t.Name] = d
+		}
+		all = append(all, nd)
+	}
+
+	var customProxy bool
+	for _, gc := range cfg.Group {
+		if gc.Name == "" {
+			return nil, errors.New("missing group name")
+		}
+		if gc.Name == actionProxy {
+			customProxy = true
+		} else if isBuiltinAction(gc.Name) || r.outbounds[gc.Name] != nil {
+			return nil, errors.New("duplicated group name: " + gc.Name)
+		}
+		var members []namedDialer
+		for _, name := range gc.Transport {
+			nd, ok := named[name]
+			if !ok {
+				return nil, fmt.Errorf("group %s: unknown transport %s", gc.Name, name)
+			}
+			members = append(members, nd)
+		}
+		if gc.HealthCheck == nil {
+			gc.HealthCheck = cfg.HealthCheck
+		}
+		g, err := newDialerGroup(gc, members)
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %s", gc.Name, err)
+		}
+		r.groups = append(r.groups, g)
+		r.outbounds[gc.Name] = g
+	}
+	if !customProxy && len(all) > 0 {
+		g, err := newDialerGroup(config.GroupConfig{Name: actionProxy, HealthCheck: cfg.HealthCheck}, all)
+		if err != nil {
+			return nil, err
+		}
+		r.groups = append(r.groups, g)
+		r.outbounds[actionProxy] = g
+	}
+
+	if cfg.ResolveIP {
+		r.resolver = newResolver()
+	}
+	for _, c := range cfg.Listen {
+		if c.Protocol != config.ProtoDNS || c.FakeIP == "" || r.fakeIPs[c.FakeIP] != nil {
+			continue
+		}
+		pool, err := dns.NewFakeIPPool(c.FakeIP)
+		if err != nil {
+			return nil, fmt.Errorf("fake IP: %s", err)
+		}
+		if r.fakeIPs == nil {
+			r.fakeIPs = make(map[string]*dns.FakeIPPool)
+		}
+		r.fakeIPs[c.FakeIP] = pool
+	}
+	r.geo = &geoLoader{ipPath: cfg.GeoIP, sitePath: cfg.GeoSite}
+	if cfg.Block != "" {
+		h, err := parseHostMatcher(cfg.Block, r.geo)
+		if err != nil {
+			return nil, fmt.Errorf("block: %s", err)
+		}
+		r.rules = append(r.rules, rule{text: "block", cond: hostCond{h}, action: actionReject})
+	}
+	if cfg.Bypass != "" {
+		h, err := parseHostMatcher(cfg.Bypass, r.geo)
+		if err != nil {
+			return nil, fmt.Errorf("bypass: %s", err)
+		}
+		r.rules = append(r.rules, rule{text: "bypass", cond: hostCond{h}, action: actionDirect})
+	}
+	var final bool
+	for _, s := range cfg.Rules {
+		ru, err := parseRule(s, r.geo)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ru.cond.(allCond); ok {
+			final = true
+		}
+		r.rules = append(r.rules, ru)
+	}
+	// domain lists have been loaded, release the rest of geosite
+	r.geo.siteDB = nil
+	if !final {
+		r.rules = append(r.rules, rule{text: "default", cond: allCond{}, action: actionProxy})
+	}
+
+	for _, ru := range r.rules {
+		// the outbound of action proxy may be specified by listener
+		if _, ok := r.outbounds[ru.action]; ok || isBuiltinAction(ru.action) {
+			continue
+		}
+		return nil, fmt.Errorf("rule %q: unknown action %s", ru.text, ru.action)
+	}
+	return r, nil
+}
+
+func isBuiltinAction(name string) bool {
+	return name == actionDirect || name == actionReject || name == actionProxy
+}
+
+// route returns the action of the first rule that matches the connection
+func (r *router) route(inbound, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	t := target{inbound: inbound, host: strings.ToLower(host), ip: net.ParseIP(host), resolver: r.resolver}
+	if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+		t.port = uint16(p)
+	}
+	// match without resolving the domain first, so that it is
+	// resolved only when no rule matches except the final one
+	if t.ip == nil && t.resolver != nil {
+		t.deferResolve = true
+		for _, ru := range r.rules {
+			if _, ok := ru.cond.(allCond); ok {
+				break
+			}
+			if ru.cond.match(&t) {
+				logger.Debug.Printf("route %s from %q to %s, rule %q", address, inbound, ru.action, ru.text)
+				return ru.action, nil
+			}
+		}
+		t.deferResolve = false
+	}
+	for _, ru := range r.rules {
+		if ru.cond.match(&t) {
+			logger.Debug.Printf("route %s from %q to %s, rule %q", address, inbound, ru.action, ru.text)
+			return ru.action, nil
+		}
+	}
+	return actionProxy, nil
+}
+
+// restore translates the fake IP of address back to the domain name
+func (r *router) restore(address string) (string, error) {
+	if len(r.fakeIPs) == 0 {
+		return address, nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return address, nil
+	}
+	for _, pool := range r.fakeIPs {
+		if !pool.Contains(ip) {
+			continue
+		}
+		name, ok := pool.Domain(ip)
+		if !ok {
+			return "", errors.New("unknown fake IP: " + host)
+		}
+		return net.JoinHostPort(name, port), nil
+	}
+	return address, nil
+}
+
+// outbound returns the dialer for the connection from inbound,
+// proxy is the outbound for action "proxy".
+func (r *router) outbound(inbound, proxy, address string) (transport.Dialer, error) {
+	action, err := r.route(inbound, address)
+	if err != nil {
+		return nil, err
+	}
+	if action == actionReject {
+		return nil, errors.New("host was blocked")
+	}
+	if action == actionProxy && proxy != "" {
+		action = proxy
+	}
+	d, ok := r.outbounds[action]
+	if !ok {
+		if action == actionProxy {
+			return nil, errors.New("missing transport config")
+		}
+		return nil, errors.New("unknown outbound: " + action)
+	}
+	return d, nil
+}
+
+// dialer returns a dialer that routes connections accepted by the inbound,
+// the outbound is taken by action "proxy" if not empty.
+func (r *router) dialer(inbound, outbound string) (*inboundDialer, error) {
+	if outbound != "" {
+		if _, ok := r.outbounds[outbound]; !ok || outbound == actionReject {
+			return nil, errors.New("unknown outbound: " + outbound)
+		}
+	} else if _, ok := r.outbounds[actionProxy]; !ok && r.needProxy() {
+		return nil, errors.New("missing transport config")
+	}
+	return &inboundDialer{router: r, inbound: inbound, outbound: outbound}, nil
+}
+
+// needProxy reports whether any reachable rule takes action "proxy"
+func (r *router) needProxy() bool {
+	for _, ru := range r.rules {
+		if ru.action == actionProxy {
+			return true
+		}
+		// rules after final never match
+		if _, ok := ru.cond.(allCond); ok {
+			return false
+		}
+	}
+	return false
+}
+
+func (r *router) Close() error {
+	if r.geo != nil {
+		r.geo.Close()
+	}
+	for _, g := range r.groups {
+		g.Close()
+	}
+	for _, d := range r.transports {
+		if c, ok := d.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	return nil
+}
+
+// inboundDialer dials on behalf of a listener, the listener name
+// takes part in routing.
+type inboundDialer struct {
+	router   *router
+	inbound  string
+	outbound string
+}
+
+func (d *inboundDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	address, err := d.router.restore(address)
+	if err != nil {
+		return nil, err
+	}
+	ob, err := d.router.outbound(d.inbound, d.outbound, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ob.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug.Printf("connected to %s", address)
+	return conn, nil
+}
+
+func (d *inboundDialer) DialPacket(ctx context.Context, address string) (net.Conn, error) {
+	address, err := d.router.restore(address)
+	if err != nil {
+		return nil, err
+	}
+	ob, err := d.router.outbound(d.inbound, d.outbound, address)
+	if err != nil {
+		return nil, err
+	}
+	pd, ok := ob.(transport.PacketDialer)
+	if !ok {
+		return nil, errors.New("transport does not support UDP")
+	}
+	conn, err := pd.DialPacket(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug.Printf("connected to udp %s", address)
+	return conn, nil
+}
+
+// Route implements dns.Router, it returns nil dialer
+// if the domain name should be resolved locally.
+func (d *inboundDialer) Route(name string) (transport.Dialer, error) {
+	ob, err := d.router.outbound(d.inbound, d.outbound, net.JoinHostPort(name, "0"))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ob.(*directDialer); ok {
+		return nil, nil
+	}
+	return ob, nil
+}
+
+// directDialer connects to destination without proxy
+type directDialer struct {
+	net.Dialer
+}
+
+func (d *directDialer) DialPacket(ctx context.Context, address string) (net.Conn, error) {
+	return d.DialContext(ctx, "udp", address)
+}
+
+type rule struct {
+	text   string // for logging
+	cond   condition
+	action string
+}
+
+// target is the destination of connection to be routed
+type target struct {
+	inbound string
+	host    string
+	ip      net.IP // not nil if host is an IP literal
+	port    uint16
+
+	resolver     *resolver // nil if resolving domain is disabled
+	deferResolve bool      // do not resolve the domain for now
+	resolved     bool
+	ips          []net.IP
+}
+
+// addrs returns the IP of target, resolving the domain name
+// if necessary. It returns nil if the IP is unknown.
+func (t *target) addrs() []net.IP {
+	if t.ip != nil {
+		return []net.IP{t.ip}
+	}
+	if t.resolver == nil || t.deferResolve {
+		return nil
+	}
+	if !t.resolved {
+		t.ips = t.resolver.resolve(t.host)
+		t.resolved = true
+	}
+	return t.ips
+}
+
+// condition reports whether the rule applies to the target
+type condition interface {
+	match(t *target) bool
+}
+
+// parseRule parses rule in form of "TYPE,VALUE,ACTION" or "final,ACTION",
+// geo loads databases for rule type geoip and geosite.
+func parseRule(s string, geo *geoLoader) (rule, error) {
+	parts := strings.Split(s, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if len(parts) == 2 && strings.EqualFold(parts[0], "final") {
+		return rule{text: s, cond: allCond{}, action: parts[1]}, nil
+	}
+	if len(parts) != 3 {
+		return rule{}, fmt.Errorf("invalid rule %q", s)
+	}
+
+	typ, value, action := strings.ToLower(parts[0]), parts[1], parts[2]
+	var cond condition
+	switch typ {
+	case "domain":
+		cond = domainCond{domain: strings.ToLower(value)}
+	case "domain-suffix":
+		cond = domainSuffixCond{domainMatch{host: strings.ToLower(value)}}
+	case "domain-keyword":
+		cond = domainKeywordCond{keyword: strings.ToLower(value)}
+	case "regex", "domain-regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return rule{}, fmt.Errorf("rule %q: %s", s, err)
+		}
+		cond = domainRegexCond{re: re}
+	case "ip-cidr":
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return rule{}, fmt.Errorf("rule %q: %s", s, err)
+		}
+		cond = cidrCond{cidrMatch{cidr: ipnet}}
+	case "dst-port":
+		c, err := parsePortCond(value)
+		if err != nil {
+			return rule{}, fmt.Errorf("rule %q: %s", s, err)
+		}
+		cond = c
+	case "inbound":
+		cond = inboundCond{name: value}
+	case "geoip":
+		db, err := geo.ipDatabase()
+		if err != nil {
+			return rule{}, fmt.Errorf("rule %q: %s", s, err)
+		}
+		cond = geoIPCond{geoIPMatch{db: db, country: strings.ToLower(value)}}
+	case "geosite":
+		list, err := geo.siteList(value)
+		if err != nil {
+			return rule{}, fmt.Errorf("rule %q: %s", s, err)
+		}
+		cond = geoSiteCond{geoSiteMatch{list: list}}
+	default:
+		return rule{}, fmt.Errorf("rule %q: unknown type %s", s, typ)
+	}
+	return rule{text: s, cond: cond, action: action}, nil
+}
+
+// allCond matches any target
+type allCond struct{}
+
+func (allCond) match(t *target) bool {
+	return true
+}
+
+// hostCond matches target by hostMatcher
+type hostCond struct {
+	*hostMatcher
+}
+
+func (c hostCond) match(t *target) bool {
+	if c.hostMatcher.match(t.host, t.ip) {
+		return true
+	}
+	// no domain matches, try the resolved IP if any IP matcher
+	if t.ip != nil || len(c.ipMatchers) == 0 {
+		return false
+	}
+	for _, ip := range t.addrs() {
+		if c.hostMatcher.match("", ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainCond matches the exact domain name
+type domainCond struct {
+	domain string
+}
+
+func (c domainCond) match(t *target) bool {
+	return t.ip == nil && t.host == c.domain
+}
+
+// domainSuffixCond matches a domain name and all subdomains
+type domainSuffixCond struct {
+	domainMatch
+}
+
+func (c domainSuffixCond) match(t *target) bool {
+	return t.ip == nil && c.domainMatch.match(t.host, nil)
+}
+
+// domainKeywordCond matches domain name that contains the keyword
+type domainKeywordCond struct {
+	keyword string
+}
+
+func (c domainKeywordCond) match(t *target) bool {
+	return t.ip == nil && strings.Contains(t.host, c.keyword)
+}
+
+// domainRegexCond matches domain name by regular expression
+type domainRegexCond struct {
+	re *regexp.Regexp
+}
+
+func (c domainRegexCond) match(t *target) bool {
+	return t.ip == nil && c.re.MatchString(t.host)
+}
+
+// cidrCond matches IP address within the CIDR
+type cidrCond struct {
+	cidrMatch
+}
+
+func (c cidrCond) match(t *target) bool {
+	for _, ip := range t.addrs() {
+		if c.cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// portCond matches destination port in range [from, to]
+type portCond struct {
+	from, to uint16
+}
+
+// parsePortCond parses a port like "443", or a port range like "8000-8080"
+func parsePortCond(s string) (portCond, error) {
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		to = from
+	}
+	f, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return portCond{}, errors.New("invalid port: " + from)
+	}
+	t, err := strconv.ParseUint(to, 10, 16)
+	if err != nil {
+		return portCond{}, errors.New("invalid port: " + to)
+	}
+	if f > t {
+		return portCond{}, errors.New("invalid port range: " + s)
+	}
+	return portCond{from: uint16(f), to: uint16(t)}, nil
+}
+
+func (c portCond) match(t *target) bool {
+	return c.from <= t.port && t.port <= c.to
+}
+
+// geoIPCond matches IP address located in the country
+type geoIPCond struct {
+	geoIPMatch
+}
+
+func (c geoIPCond) match(t *target) bool {
+	for _, ip := range t.addrs() {
+		if c.geoIPMatch.match("", ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoSiteCond matches domain name in the geosite list
+type geoSiteCond struct {
+	geoSiteMatch
+}
+
+func (c geoSiteCond) match(t *target) bool {
+	return t.ip == nil && c.geoSiteMatch.match(t.host, nil)
+}
+
+// inboundCond matches connections accepted by the named listener
+type inboundCond struct {
+	name string
+}
+
+func (c inboundCond) match(t *target) bool {
+	return t.inbound == c.name
+}
+
+type hostMatcher struct {
+	ipMatchers     []matcher
+	domainMatchers []matcher
+}
+
+// parseHostMatcher parses the comma-separated hosts, geo loads databases
+// for values like "geoip:cn" and "geosite:google".
+func parseHostMatcher(s string, geo *geoLoader) (*hostMatcher, error) {
+	var h hostMatcher
+	for _, host := range strings.Split(s, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if len(host) == 0 {
+			continue
+		}
+
+		if host == "*" {
+			h.ipMatchers = []matcher{allMatch{}}
+			h.domainMatchers = []matcher{allMatch{}}
+			break
+		}
+
+		if code, found := strings.CutPrefix(host, "geoip:"); found {
+			db, err := geo.ipDatabase()
+			if err != nil {
+				return nil, err
+			}
+			h.ipMatchers = append(h.ipMatchers, geoIPMatch{db: db, country: code})
+			continue
+		}
+
+		if code, found := strings.CutPrefix(host, "geosite:"); found {
+			list, err := geo.siteList(code)
+			if err != nil {
+				return nil, err
+			}
+			h.domainMatchers = append(h.domainMatchers, geoSiteMatch{list: list})
+			continue
+		}
+
+		// IP/CIDR
+		if _, pnet, err := net.ParseCIDR(host); err == nil {
+			h.ipMatchers = append(h.ipMatchers, cidrMatch{cidr: pnet})
+			continue
+		}
+
+		// IP
+		if pip := net.ParseIP(host); pip != nil {
+			h.ipMatchers = append(h.ipMatchers, ipMatch{ip: pip})
+			continue
+		}
+
+		// domain name
+		phost := strings.TrimPrefix(host, "*.")
+		h.domainMatchers = append(h.domainMatchers, domainMatch{host: phost})
+	}
+	return &h, nil
+}
+
+// match reports whether the host or ip matches any value of the list,
+// ip must be nil if host is not an IP literal.
+func (h *hostMatcher) match(host string, ip net.IP) bool {
+	if ip != nil {
+		for _, m := range h.ipMatchers {
+			if m.match("", ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, m := range h.domainMatchers {
+		if m.match(host, nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// matcher represents the matching rule for a given value in the NO_PROXY list
+type matcher interface {
+	// match returns true if the host or ip are allowed
+	match(host string, ip net.IP) bool
+}
+
+// allMatch matches on all possible inputs
+type allMatch struct{}
+
+func (a allMatch) match(host string, ip net.IP) bool {
+	return true
+}
+
+type cidrMatch struct {
+	cidr *net.IPNet
+}
+
+func (m cidrMatch) match(host string, ip net.IP) bool {
+	return m.cidr.Contains(ip)
+}
+
+type ipMatch struct {
+	ip net.IP
+}
+
+func (m ipMatch) match(host string, ip net.IP) bool {
+	return m.ip.Equal(ip)
+}
+
+// domainMatch matches a domain name and all subdomains.
+// For example "foo.com" matches "foo.com" and "bar.foo.com", but not "xfoo.com"
+type domainMatch struct {
+	host string
+}
+
+func (m domainMatch) match(host string, ip net.IP) bool {
+	before, found := strings.CutSuffix(host, m.host)
+	if !found {
+		return false
+	}
+	return before == "" || before[len(before)-1] == '.'
+}
+
+// geoIPMatch matches IP address located in the country
+type geoIPMatch struct {
+	db      *geo.IPDB
+	country string
+}
+
+func (m geoIPMatch) match(host string, ip net.IP) bool {
+	return m.db.Country(ip) == m.country
+}
+
+// geoSiteMatch matches domain name in the geosite list
+type geoSiteMatch struct {
+	list *geo.DomainList
+}
+
+func (m geoSiteMatch) match(host string, ip net.IP) bool {
+	return m.list.Match(host)
+}
+
+// geoLoader opens geo databases on first use
+type geoLoader struct {
+	ipPath   string
+	sitePath string
+	ipDB     *geo.IPDB
+	siteDB   *geo.SiteDB
+}
+
+func (l *geoLoader) ipDatabase() (*geo.IPDB, error) {
+	if l == nil || l.ipPath == "" {
+		return nil, errors.New("missing geoip database")
+	}
+	if l.ipDB == nil {
+		db, err := geo.OpenIPDB(l.ipPath)
+		if err != nil {
+			return nil, err
+		}
+		l.ipDB = db
+	}
+	return l.ipDB, nil
+}
+
+func (l *geoLoader) siteList(code string) (*geo.DomainList, error) {
+	if l == nil || l.sitePath == "" {
+		return nil, errors.New("missing geosite database")
+	}
+	if l.siteDB == nil {
+		db, err := geo.OpenSiteDB(l.sitePath)
+		if err != nil {
+			return nil, err
+		}
+		l.siteDB = db
+	}
+	return l.siteDB.List(code)
+}
+
+func (l *geoLoader) Close() error {
+	if l.ipDB != nil {
+		return l.ipDB.Close()
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/chenen3/yeager/config"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestRoute(t *testing.T) {
+	cfg := config.Config{
+		Transport: []config.ServerConfig{
+			{Name: "a", Protocol: config.ProtoShadowsocks, Address: "127.0.0.1:1", Cipher: "aes-256-gcm", Secret: "x"},
+		},
+		Block:  "ads.example.com",
+		Bypass: "192.168.0.0/16,localhost",
+		Rules: []string{
+			"domain,example.com,direct",
+			"domain-suffix,google.com,a",
+			"domain-keyword,video,a",
+			"regex,^cdn[0-9]+\\.,reject",
+			"domain-regex,^img[0-9]+\\.,reject",
+			"ip-cidr,10.0.0.0/8,direct",
+			"dst-port,8000-8080,a",
+			"inbound,lan,reject",
+			"final,direct",
+		},
+	}
+	r, err := newRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	tests := []struct {
+		inbound string
+		addr    string
+		want    string
+	}{
+		{addr: "ads.example.com:443", want: actionReject},
+		{addr: "192.168.1.1:80", want: actionDirect},
+		{addr: "localhost:80", want: actionDirect},
+		{addr: "example.com:443", want: actionDirect},
+		{addr: "www.example.com:443", want: actionDirect},
+		{addr: "www.google.com:443", want: "a"},
+		{addr: "google.com:443", want: "a"},
+		{addr: "fakegoogle.com:443", want: actionDirect},
+		{addr: "myvideo.net:443", want: "a"},
+		{addr: "cdn1.foo.com:443", want: actionReject},
+		{addr: "img1.foo.com:443", want: actionReject},
+		{addr: "10.1.2.3:22", want: actionDirect},
+		{addr: "1.1.1.1:8080", want: "a"},
+		{inbound: "lan", addr: "1.1.1.1:443", want: actionReject},
+		{addr: "1.1.1.1:443", want: actionDirect},
+	}
+	for _, tt := range tests {
+		got, err := r.route(tt.inbound, tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("route(%q, %q) = %s, want %s", tt.inbound, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	valid := []string{
+		"domain,example.com,direct",
+		"DOMAIN-SUFFIX, example.com , proxy",
+		"dst-port,443,reject",
+		"final,proxy",
+	}
+	for _, s := range valid {
+		if _, err := parseRule(s, nil); err != nil {
+			t.Errorf("parseRule(%q): %s", s, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"domain,example.com",
+		"unknown,example.com,direct",
+		"ip-cidr,10.0.0.1,direct",
+		"dst-port,8080-80,direct",
+		"regex,[,direct",
+		"geoip,cn,direct",
+		"geosite,cn,direct",
+	}
+	for _, s := range invalid {
+		if _, err := parseRule(s, nil); err == nil {
+			t.Errorf("parseRule(%q) expects error", s)
+		}
+	}
+}
+
+func TestNewRouterUnknownAction(t *testing.T) {
+	cfg := config.Config{Rules: []string{"domain,example.com,nowhere", "final,direct"}}
+	if _, err := newRouter(cfg); err == nil {
+		t.Fatal("expected error for unknown action")
+	}
+
+	cfg = config.Config{Rules: []string{"domain,example.com,direct"}}
+	r, err := newRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.dialer("", ""); err == nil {
+		t.Fatal("expected error for missing transport")
+	}
+
+	// direct-only client does not need transport
+	cfg = config.Config{Rules: []string{"domain,example.com,reject", "final,direct"}}
+	r2, err := newRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	if _, err := r2.dialer("", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutbound(t *testing.T) {
+	ss := func(name string) config.ServerConfig {
+		return config.ServerConfig{Name: name, Protocol: config.ProtoShadowsocks, Address: "127.0.0.1:1", Cipher: "aes-256-gcm", Secret: "x"}
+	}
+	cfg := config.Config{
+		Transport: []config.ServerConfig{ss("a"), ss("b"), ss("c")},
+		Group: []config.GroupConfig{
+			{Name: "streaming", Transport: []string{"a"}},
+			{Name: "work", Transport: []string{"b", "c"}},
+		},
+		Rules: []string{"domain-suffix,video.com,streaming", "domain-suffix,work.com,work"},
+	}
+	r, err := newRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	tests := []struct {
+		proxy string
+		addr  string
+		want  string
+	}{
+		{addr: "www.video.com:443", want: "streaming"},
+		{addr: "www.work.com:443", want: "work"},
+		{addr: "example.com:443", want: actionProxy},
+		{proxy: "c", addr: "example.com:443", want: "c"},
+		{proxy: "c", addr: "www.video.com:443", want: "streaming"},
+	}
+	for _, tt := range tests {
+		got, err := r.outbound("", tt.proxy, tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != r.outbounds[tt.want] {
+			t.Errorf("outbound(%q, %q) is not %s", tt.proxy, tt.addr, tt.want)
+		}
+	}
+
+	if _, err := r.dialer("", "unknown"); err == nil {
+		t.Error("expected error for unknown outbound")
+	}
+	cfg.Group = append(cfg.Group, config.GroupConfig{Name: "bad", Transport: []string{"x"}})
+	if _, err := newRouter(cfg); err == nil {
+		t.Error("expected error for unknown transport in group")
+	}
+}
+
+func TestGeoSite(t *testing.T) {
+	// GeoSiteList{entry: [GeoSite{country_code: "CN", domain: [Domain{type: Domain, value: "cn"}]}]}
+	var domain, site, list []byte
+	domain = protowire.AppendTag(domain, 1, protowire.VarintType)
+	domain = protowire.AppendVarint(domain, 2)
+	domain = protowire.AppendTag(domain, 2, protowire.BytesType)
+	domain = protowire.AppendString(domain, "cn")
+	site = protowire.AppendTag(site, 1, protowire.BytesType)
+	site = protowire.AppendString(site, "CN")
+	site = protowire.AppendTag(site, 2, protowire.BytesType)
+	site = protowire.AppendBytes(site, domain)
+	list = protowire.AppendTag(list, 1, protowire.BytesType)
+	list = protowire.AppendBytes(list, site)
+	path := filepath.Join(t.TempDir(), "geosite.dat")
+	if err := os.WriteFile(path, list, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Config{
+		GeoSite: path,
+		Block:   "geosite:cn",
+		Rules:   []string{"geosite,cn,direct", "final,direct"},
+	}
+	r, err := newRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for addr, want := range map[string]string{
+		"www.example.cn:443":  actionReject,
+		"www.example.com:443": actionDirect,
+	} {
+		got, err := r.route("", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("route(%q) = %s, want %s", addr, got, want)
+		}
+	}
+
+	cfg.GeoSite = ""
+	if _, err := newRouter(cfg); err == nil {
+		t.Fatal("expected error for missing geosite database")
+	}
+}
+
+func TestResolveIP(t *testing.T) {
+	cfg := config.Config{
+		Bypass:    "192.168.0.0/16",
+		Rules:     []string{"ip-cidr,10.0.0.0/8,reject", "final,a"},
+		Transport: []config.ServerConfig{{Name: "a", Protocol: config.ProtoShadowsocks, Address: "127.0.0.1:1", Cipher: "aes-256-gcm", Secret: "x"}},
+	}
+	r, err := newRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, _ := r.route("", "nas.local:443"); got != "a" {
+		t.Fatalf("resolving is disabled by default, got %s", got)
+	}
+
+	cfg.ResolveIP = true
+	r, err = newRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	hosts := map[string]string{"nas.local": "192.168.1.2", "db.internal": "10.1.1.1"}
+	var lookups int
+	r.resolver.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		lookups++
+		if ip, ok := hosts[host]; ok {
+			return []net.IP{net.ParseIP(ip)}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"nas.local:443", actionDirect},
+		{"db.internal:5432", actionReject},
+		{"example.com:443", "a"},
+		{"nas.local:80", actionDirect},
+	}
+	for _, tt := range tests {
+		got, err := r.route("", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("route(%q) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+	if lookups != 3 {
+		t.Errorf("got %d lookups, want 3", lookups)
+	}
+
+	// no IP matcher, no need to resolve
+	cfg.Bypass = "nas.local"
+	cfg.Rules = []string{"final,a"}
+	r, err = newRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	lookups = 0
+	r.resolver.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		lookups++
+		return nil, errors.New("no such host")
+	}
+	if got, _ := r.route("", "example.com:443"); got != "a" {
+		t.Errorf("route(example.com:443) = %s, want a", got)
+	}
+	if lookups != 0 {
+		t.Errorf("got %d lookups, want 0", lookups)
+	}
+
+	// the domain rule after IP rule decides without resolving
+	cfg.Bypass = ""
+	cfg.Rules = []string{"ip-cidr,10.0.0.0/8,reject", "domain-suffix,example.com,a", "final,direct"}
+	r, err = newRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	lookups = 0
+	r.resolver.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		lookups++
+		return []net.IP{net.ParseIP("10.1.1.1")}, nil
+	}
+	if got, _ := r.route("", "www.example.com:443"); got != "a" {
+		t.Errorf("route(www.example.com:443) = %s, want a", got)
+	}
+	if lookups != 0 {
+		t.Errorf("got %d lookups, want 0", lookups)
+	}
+	if got, _ := r.route("", "db.internal:5432"); got != actionReject {
+		t.Errorf("route(db.internal:5432) = %s, want %s", got, actionReject)
+	}
+	if lookups != 1 {
+		t.Errorf("got %d lookups, want 1", lookups)
+	}
+}
+
+func TestRestoreFakeIP(t *testing.T) {
+	cfg := config.Config{
+		Listen: []config.ServerConfig{{Protocol: config.ProtoDNS, FakeIP: "198.18.0.0/15"}},
+	}
+	r, err := newRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ip := r.fakeIPs["198.18.0.0/15"].Lookup("example.com")
+	got, err := r.restore(net.JoinHostPort(ip.String(), "443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "example.com:443" {
+		t.Errorf("got %s, want example.com:443", got)
+	}
+	if got, _ := r.restore("1.1.1.1:53"); got != "1.1.1.1:53" {
+		t.Errorf("got %s, want 1.1.1.1:53", got)
+	}
+	if _, err := r.restore("198.19.0.1:443"); err == nil {
+		t.Error("expected error for unallocated fake IP")
+	}
+}
+
+func TestResolverCacheSize(t *testing.T) {
+	r := newResolver()
+	r.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.IPv4(10, 0, 0, 1)}, nil
+	}
+	for i := 0; i < maxResolveCacheSize+10; i++ {
+		r.resolve(strconv.Itoa(i) + ".example.com")
+	}
+	if n := len(r.cache); n > maxResolveCacheSize {
+		t.Fatalf("got %d cached entries, want at most %d", n, maxResolveCacheSize)
+	}
+}
@@ -2,22 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/chenen3/yeager/config"
+	"github.com/chenen3/yeager/dns"
 	"github.com/chenen3/yeager/logger"
 	"github.com/chenen3/yeager/proxy"
 	"github.com/chenen3/yeager/transport"
 	"github.com/chenen3/yeager/transport/grpc"
 	"github.com/chenen3/yeager/transport/http2"
 	"github.com/chenen3/yeager/transport/https"
+	"github.com/chenen3/yeager/transport/quic"
 	"github.com/chenen3/yeager/transport/shadowsocks"
+	"github.com/chenen3/yeager/transport/socks5"
+	"github.com/chenen3/yeager/transport/trojan"
+	"github.com/chenen3/yeager/transport/websocket"
 )
 
 // start the service specified by config.
@@ -38,29 +47,29 @@ func start(cfg config.Config) (stop func(), err error) {
 		return nil, errors.New("missing client and server config")
 	}
 
-	var dialer transport.Dialer
-	getDialer := func() (transport.Dialer, error) {
-		if dialer != nil {
-			return dialer, nil
-		}
-		if len(cfg.Transport) == 0 {
-			return nil, errors.New("missing transport config")
+	var r *router
+	getRouter := func() (*router, error) {
+		if r == nil {
+			rt, err := newRouter(cfg)
+			if err != nil {
+				return nil, err
+			}
+			onStop = append(onStop, rt.Close)
+			r = rt
 		}
-		d, err := newDialerGroup(cfg.Transport, cfg.Bypass, cfg.Block)
-		if err != nil {
+		return r, nil
+	}
+	getDialer := func(inbound, outbound string) (*inboundDialer, error) {
+		if _, err := getRouter(); err != nil {
 			return nil, err
 		}
-		if v, ok := d.(io.Closer); ok {
-			onStop = append(onStop, v.Close)
-		}
-		dialer = d
-		return dialer, nil
+		return r.dialer(inbound, outbound)
 	}
 
 	for _, c := range cfg.Listen {
 		switch c.Protocol {
 		case config.ProtoHTTP:
-			dialer, err := getDialer()
+			dialer, err := getDialer(c.Name, c.Outbound)
 			if err != nil {
 				return nil, err
 			}
@@ -68,7 +77,7 @@ func start(cfg config.Config) (stop func(), err error) {
 			if err != nil {
 				return nil, err
 			}
-			s := &http.Server{Handler: proxy.NewHTTPHandler(dialer)}
+			s := &http.Server{Handler: proxy.NewHTTPHandler(dialer, c.Username, c.Password)}
 			go func() {
 				err := s.Serve(listener)
 				if err != nil && err != http.ErrServerClosed {
@@ -77,7 +86,7 @@ func start(cfg config.Config) (stop func(), err error) {
 			}()
 			onStop = append(onStop, s.Close)
 		case config.ProtoSOCKS5:
-			dialer, err := getDialer()
+			dialer, err := getDialer(c.Name, c.Outbound)
 			if err != nil {
 				return nil, err
 			}
@@ -85,7 +94,7 @@ func start(cfg config.Config) (stop func(), err error) {
 			if err != nil {
 				return nil, err
 			}
-			s := proxy.NewSOCKS5Server(dialer)
+			s := proxy.NewSOCKS5Server(dialer, c.Username, c.Password)
 			go func() {
 				err := s.Serve(listener)
 				if err != nil {
@@ -93,12 +102,102 @@ func start(cfg config.Config) (stop func(), err error) {
 				}
 			}()
 			onStop = append(onStop, s.Close)
+		case config.ProtoMixed:
+			dialer, err := getDialer(c.Name, c.Outbound)
+			if err != nil {
+				return nil, err
+			}
+			listener, err := net.Listen("tcp", c.Address)
+			if err != nil {
+				return nil, err
+			}
+			s := proxy.NewMixedServer(dialer, c.Username, c.Password)
+			go func() {
+				err := s.Serve(listener)
+				if err != nil {
+					logger.Error.Printf("serve mixed: %s", err)
+				}
+			}()
+			onStop = append(onStop, s.Close)
+		case config.ProtoDNS:
+			dialer, err := getDialer(c.Name, c.Outbound)
+			if err != nil {
+				return nil, err
+			}
+			pc, err := net.ListenPacket("udp", c.Address)
+			if err != nil {
+				return nil, err
+			}
+			listener, err := net.Listen("tcp", c.Address)
+			if err != nil {
+				pc.Close()
+				return nil, err
+			}
+			s := dns.NewServer(dialer, c.Upstream, c.LocalUpstream, r.fakeIPs[c.FakeIP])
+			go func() {
+				err := s.ServePacket(pc)
+				if err != nil {
+					logger.Error.Printf("serve dns: %s", err)
+				}
+			}()
+			go func() {
+				err := s.Serve(listener)
+				if err != nil {
+					logger.Error.Printf("serve dns: %s", err)
+				}
+			}()
+			onStop = append(onStop, s.Close)
+		case config.ProtoRedirect, config.ProtoTProxy:
+			dialer, err := getDialer(c.Name, c.Outbound)
+			if err != nil {
+				return nil, err
+			}
+			newServer := proxy.NewRedirectServer
+			var listener net.Listener
+			if c.Protocol == config.ProtoTProxy {
+				newServer = proxy.NewTProxyServer
+				listener, err = proxy.ListenTProxy(c.Address)
+			} else {
+				listener, err = net.Listen("tcp", c.Address)
+			}
+			if err != nil {
+				return nil, err
+			}
+			s := newServer(dialer)
+			proto := c.Protocol
+			go func() {
+				err := s.Serve(listener)
+				if err != nil {
+					logger.Error.Printf("serve %s: %s", proto, err)
+				}
+			}()
+			onStop = append(onStop, s.Close)
+		case config.ProtoForward:
+			if c.Target == "" {
+				return nil, errors.New("forward: missing target")
+			}
+			dialer, err := getDialer(c.Name, c.Outbound)
+			if err != nil {
+				return nil, err
+			}
+			listener, err := net.Listen("tcp", c.Address)
+			if err != nil {
+				return nil, err
+			}
+			s := proxy.NewForwardServer(dialer, c.Target)
+			go func() {
+				err := s.Serve(listener)
+				if err != nil {
+					logger.Error.Printf("serve forward: %s", err)
+				}
+			}()
+			onStop = append(onStop, s.Close)
 		case config.ProtoGRPC:
 			tlsConf, err := c.ServerTLS()
 			if err != nil {
 				return nil, err
 			}
-			s, err := grpc.NewServer(c.Address, tlsConf)
+			s, err := grpc.NewServer(c.Address, tlsConf, c.Reverse)
 			if err != nil {
 				return nil, err
 			}
@@ -111,7 +210,60 @@ func start(cfg config.Config) (stop func(), err error) {
 			if err != nil {
 				return nil, err
 			}
-			s, err := http2.NewServer(c.Address, tlsConf, c.Username, c.Password)
+			s, err := http2.NewServer(c.Address, tlsConf, c.Username, c.Password, c.Reverse)
+			if err != nil {
+				return nil, err
+			}
+			onStop = append(onStop, s.Close)
+		case config.ProtoWebSocket:
+			var tlsConf *tls.Config
+			if c.CertPEM != nil {
+				conf, err := c.ServerTLS()
+				if err != nil {
+					return nil, err
+				}
+				tlsConf = conf
+			} else if c.Username == "" {
+				return nil, errors.New("ws: missing certificate or username")
+			}
+			s, err := websocket.NewServer(c.Address, tlsConf, c.Path, c.Username, c.Password)
+			if err != nil {
+				return nil, err
+			}
+			onStop = append(onStop, s.Close)
+		case config.ProtoQUIC:
+			tlsConf, err := c.ServerTLS()
+			if err != nil {
+				return nil, err
+			}
+			s, err := quic.NewServer(c.Address, tlsConf)
+			if err != nil {
+				return nil, err
+			}
+			onStop = append(onStop, s.Close)
+		case config.ProtoTrojan:
+			if c.Password == "" {
+				return nil, errors.New("trojan: missing password")
+			}
+			// clients are authenticated by password, unless CA is
+			// configured for mutual TLS
+			var tlsConf *tls.Config
+			var err error
+			if c.CAPEM != nil {
+				tlsConf, err = c.ServerTLS()
+			} else {
+				tlsConf, err = c.CertTLS()
+			}
+			if err != nil {
+				return nil, err
+			}
+			s, err := trojan.NewServer(c.Address, tlsConf, c.Password, c.Fallback)
+			if err != nil {
+				return nil, err
+			}
+			onStop = append(onStop, s.Close)
+		case config.ProtoShadowsocks:
+			s, err := shadowsocks.NewServer(c.Address, c.Cipher, c.Secret)
 			if err != nil {
 				return nil, err
 			}
@@ -122,6 +274,22 @@ func start(cfg config.Config) (stop func(), err error) {
 		logger.Info.Printf("listen %s %s", c.Protocol, c.Address)
 	}
 
+	for _, rc := range cfg.Reverse {
+		if _, err := getRouter(); err != nil {
+			return nil, err
+		}
+		rl, ok := r.outbounds[rc.Transport].(transport.RemoteListener)
+		if !ok {
+			return nil, fmt.Errorf("reverse: transport %q does not support reverse tunnel", rc.Transport)
+		}
+		if rc.Remote == "" || rc.Target == "" {
+			return nil, errors.New("reverse: missing remote or target")
+		}
+		t := startReverse(rl, rc.Remote, rc.Target)
+		onStop = append(onStop, t.Close)
+		logger.Info.Printf("reverse tunnel %s -> %s", rc.Remote, rc.Target)
+	}
+
 	stop = func() {
 		for _, f := range onStop {
 			if e := f(); e != nil {
@@ -132,7 +300,17 @@ func start(cfg config.Config) (stop func(), err error) {
 	return stop, nil
 }
 
-func newStreamDialer(c config.ServerConfig) (transport.Dialer, error) {
+// newStreamDialer creates the dialer of transport c. If base is not nil,
+// the connections to server are dialed through it, which is supported
+// by grpc, h2, ss, http and https only.
+func newStreamDialer(c config.ServerConfig, base transport.Dialer) (transport.Dialer, error) {
+	if base != nil {
+		switch c.Protocol {
+		case config.ProtoGRPC, config.ProtoHTTP2, config.ProtoShadowsocks, config.ProtoHTTP, config.ProtoHTTPS:
+		default:
+			return nil, fmt.Errorf("transport %s does not support via", c.Protocol)
+		}
+	}
 	var dialer transport.Dialer
 	switch c.Protocol {
 	case config.ProtoGRPC:
@@ -140,66 +318,158 @@ func newStreamDialer(c config.ServerConfig) (transport.Dialer, error) {
 		if err != nil {
 			return nil, err
 		}
-		dialer = grpc.NewStreamDialer(c.Address, tlsConf)
+		dialer = grpc.NewStreamDialer(c.Address, tlsConf, base)
 	case config.ProtoHTTP2:
 		if c.Username != "" {
-			dialer = http2.NewStreamDialer(c.Address, nil, c.Username, c.Password)
+			dialer = http2.NewStreamDialer(c.Address, nil, c.Username, c.Password, base)
 		} else {
 			tlsConf, err := c.ClientTLS()
 			if err != nil {
 				return nil, err
 			}
-			dialer = http2.NewStreamDialer(c.Address, tlsConf, "", "")
+			dialer = http2.NewStreamDialer(c.Address, tlsConf, "", "", base)
 		}
+	case config.ProtoWebSocket:
+		var tlsConf *tls.Config
+		if c.CertPEM != nil {
+			conf, err := c.ClientTLS()
+			if err != nil {
+				return nil, err
+			}
+			tlsConf = conf
+		}
+		dialer = websocket.NewStreamDialer(c.Address, tlsConf, c.Path, c.Username, c.Password)
+	case config.ProtoQUIC:
+		tlsConf, err := c.ClientTLS()
+		if err != nil {
+			return nil, err
+		}
+		dialer = quic.NewStreamDialer(c.Address, tlsConf)
+	case config.ProtoTrojan:
+		var tlsConf *tls.Config
+		if c.CertPEM != nil {
+			conf, err := c.ClientTLS()
+			if err != nil {
+				return nil, err
+			}
+			tlsConf = conf
+		}
+		dialer = trojan.NewDialer(c.Address, tlsConf, c.Password)
 	case config.ProtoShadowsocks:
-		d, err := shadowsocks.NewDialer(c.Address, c.Cipher, c.Secret)
+		d, err := shadowsocks.NewDialer(c.Address, c.Cipher, c.Secret, base)
 		if err != nil {
 			return nil, err
 		}
 		dialer = d
 	case config.ProtoHTTP:
-		dialer = https.NewDialer(c.Address)
+		dialer = https.NewDialer(c.Address, nil, c.Username, c.Password, base)
+	case config.ProtoHTTPS:
+		// verify the proxy with system root CAs if no certificate
+		tlsConf := new(tls.Config)
+		if c.CertPEM != nil {
+			conf, err := c.ClientTLS()
+			if err != nil {
+				return nil, err
+			}
+			tlsConf = conf
+		}
+		dialer = https.NewDialer(c.Address, tlsConf, c.Username, c.Password, base)
+	case config.ProtoSOCKS5:
+		dialer = socks5.NewDialer(c.Address, c.Username, c.Password)
 	default:
 		return nil, errors.New("unsupported transport protocol: " + c.Protocol)
 	}
 	return dialer, nil
 }
 
+// namedDialer is a transport dialer and the name for logging
+type namedDialer struct {
+	name string
+	transport.Dialer
+}
+
 type dialerGroup struct {
-	transports []config.ServerConfig
-	mu         sync.RWMutex
-	dialer     transport.Dialer
-	bypass     *hostMatcher
-	block      *hostMatcher
-	ticker     *time.Ticker
+	name      string
+	strategy  string
+	tolerance time.Duration
+	members   []namedDialer
+	ticker    *time.Ticker
+	next      atomic.Uint32 // counter of round-robin
+
+	// health check
+	url       string
+	timeout   time.Duration
+	threshold int
+	fails     []int           // consecutive failures of members
+	latency   []time.Duration // last latency of members, negative if unhealthy
+
+	mu      sync.RWMutex
+	healthy []int // indexes of healthy members
+	current int   // index of the member picked by latency, -1 if none
 }
 
 // newDialerGroup returns a new stream dialer.
-// Given multiple transport config, it creates a dialer group to
-// perform periodic health checks and switch server if necessary.
-func newDialerGroup(transports []config.ServerConfig, bypass, block string) (transport.Dialer, error) {
-	if len(transports) == 0 {
+// Given multiple transport dialers, it creates a dialer group to
+// perform periodic health checks and dials through the healthy
+// members according to strategy. The group does not close its members.
+func newDialerGroup(gc config.GroupConfig, members []namedDialer) (*dialerGroup, error) {
+	if len(members) == 0 {
 		return nil, errors.New("missing transport config")
 	}
+	switch gc.Strategy {
+	case "":
+		gc.Strategy = config.StrategyLatency
+	case config.StrategyLatency, config.StrategyRoundRobin, config.StrategyRandom, config.StrategyHash:
+	default:
+		return nil, errors.New("unknown strategy: " + gc.Strategy)
+	}
 
-	g := new(dialerGroup)
-	if block != "" {
-		g.block = parseHostMatcher(block)
+	var hc config.HealthCheck
+	if gc.HealthCheck != nil {
+		hc = *gc.HealthCheck
 	}
-	if bypass != "" {
-		g.bypass = parseHostMatcher(bypass)
+	if hc.URL == "" {
+		hc.URL = "http://www.gstatic.com/generate_204"
 	}
-	if len(transports) == 1 {
-		d, err := newStreamDialer(transports[0])
-		if err != nil {
-			return nil, err
-		}
-		g.dialer = d
+	if hc.Interval <= 0 {
+		hc.Interval = 30
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 3
+	}
+	if hc.Threshold <= 0 {
+		hc.Threshold = 1
+	}
+
+	g := &dialerGroup{
+		name:      gc.Name,
+		strategy:  gc.Strategy,
+		tolerance: time.Duration(gc.Tolerance) * time.Millisecond,
+		members:   members,
+		current:   -1,
+		url:       hc.URL,
+		timeout:   time.Duration(hc.Timeout) * time.Second,
+		threshold: hc.Threshold,
+		fails:     make([]int, len(members)),
+		latency:   make([]time.Duration, len(members)),
+	}
+	if len(members) == 1 {
+		g.healthy = []int{0}
+		g.current = 0
 		return g, nil
 	}
+	if hc.URL == config.ProbeInBand {
+		for _, m := range members {
+			if _, ok := m.Dialer.(transport.Prober); !ok {
+				return nil, fmt.Errorf("transport %s does not support in-band health check", m.name)
+			}
+		}
+	}
+	for i := range g.latency {
+		g.latency[i] = -1
+	}
 
-	g.transports = transports
-	g.ticker = time.NewTicker(30 * time.Second)
+	g.ticker = time.NewTicker(time.Duration(hc.Interval) * time.Second)
 	go func() {
 		g.pick()
 		for range g.ticker.C {
@@ -209,214 +479,166 @@ func newDialerGroup(transports []config.ServerConfig, bypass, block string) (tra
 	return g, nil
 }
 
+// pick tests the connection through members and updates the healthy ones
 func (g *dialerGroup) pick() {
-	var winner transport.Dialer
-	var winnerCfg config.ServerConfig
-	var min time.Duration
-	for _, t := range g.transports {
-		d, err := newStreamDialer(t)
-		if err != nil {
-			logger.Error.Printf("new stream dialer: %s", err)
-			continue
-		}
-
-		du, err := testConnection(d)
+	for i, m := range g.members {
+		du, err := g.check(m)
 		if err != nil {
-			logger.Debug.Printf("test connection through %s: %s", t.Address, err)
-			continue
-		}
-
-		if winner == nil {
-			min = du
-			winner = d
-			winnerCfg = t
-		} else if du < min {
-			if v, ok := winner.(io.Closer); ok {
-				v.Close()
-			}
-			min = du
-			winner = d
-			winnerCfg = t
+			logger.Debug.Printf("test connection through %s: %s", m.name, err)
 		} else {
-			if v, ok := d.(io.Closer); ok {
-				v.Close()
-			}
+			logger.Debug.Printf("test connection through %s %dms", m.name, du.Milliseconds())
 		}
-		logger.Debug.Printf("test connection through %s %dms", t.Address, du.Milliseconds())
+		g.record(i, du, err)
 	}
-	if winner == nil {
-		logger.Error.Println("unable to find a valid transport")
-		return
-	}
-
-	if v, ok := g.dialer.(io.Closer); ok {
-		v.Close()
-	}
-	g.mu.Lock()
-	g.dialer = winner
-	g.mu.Unlock()
-	logger.Debug.Printf("pick transport: %s %s", winnerCfg.Protocol, winnerCfg.Address)
+	g.update(g.latency)
 }
 
-// implements interface transport.StreamDialer
-func (g *dialerGroup) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
-
-	if g.block != nil && g.block.match(address) {
-		return nil, errors.New("host was blocked")
-	}
-	if g.bypass != nil && g.bypass.match(address) {
-		var d net.Dialer
-		conn, err := d.DialContext(ctx, "tcp", address)
-		if err != nil {
-			return nil, err
+// check measures the latency of health check through d
+func (g *dialerGroup) check(d transport.Dialer) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	if g.url == config.ProbeInBand {
+		start := time.Now()
+		if err := d.(transport.Prober).Probe(ctx); err != nil {
+			return 0, err
 		}
-		logger.Debug.Printf("connected to %s, bypass proxy", address)
-		return conn.(*net.TCPConn), nil
-	}
-	if g.dialer == nil {
-		return nil, errors.New("no valid dialer")
-	}
-	stream, err := g.dialer.DialContext(ctx, "tcp", address)
-	if err != nil {
-		return nil, err
+		return time.Since(start), nil
 	}
-	logger.Debug.Printf("connected to %s", address)
-	return stream, nil
+	return testConnection(ctx, d, g.url)
 }
 
-func (g *dialerGroup) Close() error {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
-	if g.ticker != nil {
-		g.ticker.Stop()
+// record the result of health check, the member keeps its last
+// latency until it fails threshold times in a row
+func (g *dialerGroup) record(i int, latency time.Duration, err error) {
+	if err == nil {
+		g.fails[i] = 0
+		g.latency[i] = latency
+		return
 	}
-	if v, ok := g.dialer.(io.Closer); ok {
-		return v.Close()
+	g.fails[i]++
+	if g.fails[i] >= g.threshold {
+		g.latency[i] = -1
 	}
-	return nil
 }
 
-type hostMatcher struct {
-	ipMatchers     []matcher
-	domainMatchers []matcher
-}
-
-func parseHostMatcher(s string) *hostMatcher {
-	if s == "" {
-		return nil
-	}
-	var h hostMatcher
-	for _, host := range strings.Split(s, ",") {
-		host = strings.ToLower(strings.TrimSpace(host))
-		if len(host) == 0 {
-			continue
-		}
-
-		if host == "*" {
-			h.ipMatchers = []matcher{allMatch{}}
-			h.domainMatchers = []matcher{allMatch{}}
-			break
-		}
-
-		// IP/CIDR
-		if _, pnet, err := net.ParseCIDR(host); err == nil {
-			h.ipMatchers = append(h.ipMatchers, cidrMatch{cidr: pnet})
+// update takes the latency of each member, negative for unhealthy ones.
+// The latency strategy switches member only if the current one is
+// unhealthy or slower than the fastest one beyond tolerance.
+// If all members are unhealthy, the previous state is kept.
+func (g *dialerGroup) update(latency []time.Duration) {
+	var healthy []int
+	fastest := -1
+	for i, du := range latency {
+		if du < 0 {
 			continue
 		}
-
-		// IP
-		if pip := net.ParseIP(host); pip != nil {
-			h.ipMatchers = append(h.ipMatchers, ipMatch{ip: pip})
-			continue
+		healthy = append(healthy, i)
+		if fastest == -1 || du < latency[fastest] {
+			fastest = i
 		}
+	}
+	if fastest == -1 {
+		// keep the previous members, the probe itself may be down
+		logger.Error.Printf("group %s: unable to find a valid transport", g.name)
+		return
+	}
 
-		// domain name
-		phost := strings.TrimPrefix(host, "*.")
-		h.domainMatchers = append(h.domainMatchers, domainMatch{host: phost})
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.healthy = healthy
+	cur := g.current
+	if cur == -1 || latency[cur] < 0 || latency[cur] > latency[fastest]+g.tolerance {
+		g.current = fastest
+	}
+	if g.strategy == config.StrategyLatency && g.current != -1 && g.current != cur {
+		logger.Debug.Printf("group %s pick transport: %s", g.name, g.members[g.current].name)
 	}
-	return &h
 }
 
-func (h *hostMatcher) match(addr string) bool {
-	if len(addr) == 0 || len(h.ipMatchers)+len(h.domainMatchers) == 0 {
-		return false
+// choose returns the member to dial address according to strategy
+func (g *dialerGroup) choose(address string) (transport.Dialer, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if len(g.healthy) == 0 {
+		return nil, errors.New("no valid dialer")
 	}
-	host, _, err := net.SplitHostPort(addr)
-	if err != nil {
-		return false
+	var i int
+	switch g.strategy {
+	case config.StrategyRoundRobin:
+		i = g.healthy[(g.next.Add(1)-1)%uint32(len(g.healthy))]
+	case config.StrategyRandom:
+		i = g.healthy[rand.Intn(len(g.healthy))]
+	case config.StrategyHash:
+		i = g.hash(address)
+	default:
+		i = g.current
 	}
-	ip := net.ParseIP(host)
+	return g.members[i].Dialer, nil
+}
 
-	if ip != nil {
-		for _, m := range h.ipMatchers {
-			if m.match("", ip) {
-				return true
-			}
-		}
-		return false
+// hash picks the healthy member by rendezvous hashing on the host of address,
+// so that the same host always goes through the same member, and only the
+// hosts of an unhealthy member are moved when it fails.
+func (g *dialerGroup) hash(address string) int {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
 	}
-
-	for _, m := range h.domainMatchers {
-		if m.match(host, nil) {
-			return true
+	var winner int
+	var max uint64
+	for _, i := range g.healthy {
+		h := fnv.New64a()
+		io.WriteString(h, g.members[i].name)
+		h.Write([]byte{0})
+		io.WriteString(h, host)
+		if sum := h.Sum64(); sum >= max {
+			max = sum
+			winner = i
 		}
 	}
-	return false
+	return winner
 }
 
-// matcher represents the matching rule for a given value in the NO_PROXY list
-type matcher interface {
-	// match returns true if the host or ip are allowed
-	match(host string, ip net.IP) bool
-}
-
-// allMatch matches on all possible inputs
-type allMatch struct{}
-
-func (a allMatch) match(host string, ip net.IP) bool {
-	return true
-}
-
-type cidrMatch struct {
-	cidr *net.IPNet
-}
-
-func (m cidrMatch) match(host string, ip net.IP) bool {
-	return m.cidr.Contains(ip)
-}
-
-type ipMatch struct {
-	ip net.IP
-}
-
-func (m ipMatch) match(host string, ip net.IP) bool {
-	return m.ip.Equal(ip)
+// implements interface transport.StreamDialer
+func (g *dialerGroup) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d, err := g.choose(address)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, network, address)
 }
 
-// domainMatch matches a domain name and all subdomains.
-// For example "foo.com" matches "foo.com" and "bar.foo.com", but not "xfoo.com"
-type domainMatch struct {
-	host string
+// implements interface transport.PacketDialer
+func (g *dialerGroup) DialPacket(ctx context.Context, address string) (net.Conn, error) {
+	d, err := g.choose(address)
+	if err != nil {
+		return nil, err
+	}
+	pd, ok := d.(transport.PacketDialer)
+	if !ok {
+		return nil, errors.New("transport does not support UDP")
+	}
+	return pd.DialPacket(ctx, address)
 }
 
-func (m domainMatch) match(host string, ip net.IP) bool {
-	before, found := strings.CutSuffix(host, m.host)
-	if !found {
-		return false
+func (g *dialerGroup) Close() error {
+	if g.ticker != nil {
+		g.ticker.Stop()
 	}
-	return before == "" || before[len(before)-1] == '.'
+	return nil
 }
 
-func testConnection(d transport.Dialer) (time.Duration, error) {
+func testConnection(ctx context.Context, d transport.Dialer, url string) (time.Duration, error) {
 	client := &http.Client{
 		Transport: &http.Transport{DialContext: d.DialContext},
-		Timeout:   3 * time.Second,
 	}
 	defer client.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
 	start := time.Now()
-	resp, err := client.Get("http://www.gstatic.com/generate_204")
+	resp, err := client.Do(req)
 	if err != nil {
 		return 0, err
 	}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -9,7 +11,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/chenen3/yeager/config"
 	"github.com/chenen3/yeager/proxy"
+	"github.com/chenen3/yeager/transport"
 	"github.com/chenen3/yeager/transport/https"
 )
 
@@ -25,11 +29,11 @@ func localAddr() string {
 func TestHTTPTransport(t *testing.T) {
 	// client request -> [http proxy server A -> http transport] -> http proxy server B -> http test server
 	hostport := localAddr()
-	proxySrvA := &http.Server{Addr: localAddr(), Handler: proxy.NewHTTPHandler(https.NewDialer(hostport))}
+	proxySrvA := &http.Server{Addr: localAddr(), Handler: proxy.NewHTTPHandler(https.NewDialer(hostport, nil, "", "", nil), "", "")}
 	go proxySrvA.ListenAndServe()
 	defer proxySrvA.Close()
 
-	proxySrvB := &http.Server{Addr: hostport, Handler: proxy.NewHTTPHandler(&net.Dialer{})}
+	proxySrvB := &http.Server{Addr: hostport, Handler: proxy.NewHTTPHandler(&net.Dialer{}, "", "")}
 	go proxySrvB.ListenAndServe()
 	defer proxySrvB.Close()
 
@@ -61,3 +65,249 @@ func TestHTTPTransport(t *testing.T) {
 		t.Fatalf("want 1, got %s", bs)
 	}
 }
+
+func TestChain(t *testing.T) {
+	// client request -> http listener -> h2 server A -> grpc server B -> http test server
+	cli, srv, err := config.Generate("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvTLS, cliTLS := srv.Listen[0], cli.Transport[0]
+	addrA, addrB, proxyAddr := localAddr(), localAddr(), localAddr()
+
+	srvA, srvB := srvTLS, srvTLS
+	srvA.Protocol, srvA.Address = config.ProtoHTTP2, addrA
+	srvB.Protocol, srvB.Address = config.ProtoGRPC, addrB
+	stopServer, err := start(config.Config{Listen: []config.ServerConfig{srvA, srvB}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer()
+
+	hopA, hopB := cliTLS, cliTLS
+	hopA.Name, hopA.Protocol, hopA.Address = "a", config.ProtoHTTP2, addrA
+	hopB.Name, hopB.Protocol, hopB.Address, hopB.Via = "b", config.ProtoGRPC, addrB, "a"
+	stopClient, err := start(config.Config{
+		Listen:    []config.ServerConfig{{Protocol: config.ProtoHTTP, Address: proxyAddr}},
+		Transport: []config.ServerConfig{hopA, hopB},
+		Rules:     []string{"final,b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopClient()
+
+	testSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "1")
+	}))
+	defer testSrv.Close()
+
+	client := http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr}),
+		},
+		Timeout: 2 * time.Second,
+	}
+	// the proxy services may not started yet
+	time.Sleep(time.Millisecond)
+
+	resp, err := client.Get(testSrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "1" {
+		t.Fatalf("want 1, got %s", bs)
+	}
+
+	// an http proxy via h2 that never replies, the dial must not hang
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	hopC := config.ServerConfig{Name: "c", Protocol: config.ProtoHTTP, Address: silent.Addr().String(), Via: "a"}
+	r, err := newRouter(config.Config{Transport: []config.ServerConfig{hopA, hopC}, Rules: []string{"final,c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := r.outbounds["c"].DialContext(ctx, "tcp", "example.com:80")
+		if err == nil {
+			conn.Close()
+		}
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("expected error from silent proxy")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("dial hangs on silent proxy")
+	}
+
+	// the via transport must be declared before
+	if r, err := newRouter(config.Config{Transport: []config.ServerConfig{hopB, hopA}}); err == nil {
+		r.Close()
+		t.Fatal("expected error for undeclared via transport")
+	}
+}
+
+func TestDialerGroupStrategy(t *testing.T) {
+	var members []namedDialer
+	for _, name := range []string{"a", "b", "c"} {
+		members = append(members, namedDialer{name: name, Dialer: new(net.Dialer)})
+	}
+	newGroup := func(strategy string, tolerance time.Duration) *dialerGroup {
+		return &dialerGroup{name: "test", strategy: strategy, tolerance: tolerance, members: members, current: -1}
+	}
+	index := func(g *dialerGroup, address string) int {
+		d, err := g.choose(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, m := range members {
+			if m.Dialer == d {
+				return i
+			}
+		}
+		t.Fatal("unknown dialer")
+		return -1
+	}
+	ms := time.Millisecond
+
+	g := newGroup(config.StrategyLatency, 20*ms)
+	if _, err := g.choose("example.com:443"); err == nil {
+		t.Fatal("expected error before health check")
+	}
+	g.update([]time.Duration{50 * ms, 40 * ms, -1})
+	if i := index(g, "example.com:443"); i != 1 {
+		t.Fatalf("latency: got member %d, want 1", i)
+	}
+	// within tolerance
+	g.update([]time.Duration{30 * ms, 45 * ms, -1})
+	if i := index(g, "example.com:443"); i != 1 {
+		t.Fatalf("latency within tolerance: got member %d, want 1", i)
+	}
+	g.update([]time.Duration{20 * ms, 45 * ms, -1})
+	if i := index(g, "example.com:443"); i != 0 {
+		t.Fatalf("latency beyond tolerance: got member %d, want 0", i)
+	}
+	// all probes failed, keep the previous member
+	g.update([]time.Duration{-1, -1, -1})
+	if i := index(g, "example.com:443"); i != 0 {
+		t.Fatalf("latency after failed probes: got member %d, want 0", i)
+	}
+
+	g = newGroup(config.StrategyRoundRobin, 0)
+	g.update([]time.Duration{10 * ms, -1, 30 * ms})
+	var got []int
+	for i := 0; i < 4; i++ {
+		got = append(got, index(g, "example.com:443"))
+	}
+	if got[0] != 0 || got[1] != 2 || got[2] != 0 || got[3] != 2 {
+		t.Fatalf("round-robin: got members %v, want [0 2 0 2]", got)
+	}
+	g.update([]time.Duration{-1, -1, -1})
+	if i := index(g, "example.com:443"); i != 0 && i != 2 {
+		t.Fatalf("round-robin after failed probes: got member %d, want previous healthy", i)
+	}
+	// the counter wraps around
+	g.next.Store(1<<32 - 1)
+	index(g, "example.com:443")
+	index(g, "example.com:443")
+
+	g = newGroup(config.StrategyRandom, 0)
+	g.update([]time.Duration{-1, 20 * ms, -1})
+	if i := index(g, "example.com:443"); i != 1 {
+		t.Fatalf("random: got member %d, want the only healthy 1", i)
+	}
+
+	g = newGroup(config.StrategyHash, 0)
+	g.update([]time.Duration{10 * ms, 20 * ms, 30 * ms})
+	hosts := []string{"a.com", "b.com", "c.com", "d.com", "e.com", "f.com"}
+	before := make(map[string]int)
+	for _, h := range hosts {
+		before[h] = index(g, h+":443")
+		if i := index(g, h+":80"); i != before[h] {
+			t.Fatalf("hash: %s goes through member %d and %d", h, before[h], i)
+		}
+	}
+	// only the hosts of failed member are moved
+	g.update([]time.Duration{10 * ms, -1, 30 * ms})
+	for _, h := range hosts {
+		i := index(g, h+":443")
+		if i == 1 || before[h] != 1 && i != before[h] {
+			t.Fatalf("hash: %s moved from member %d to %d", h, before[h], i)
+		}
+	}
+
+	if _, err := newDialerGroup(config.GroupConfig{Name: "bad", Strategy: "fastest"}, members); err == nil {
+		t.Fatal("expected error for unknown strategy")
+	}
+}
+
+func TestDialerGroupHealthCheck(t *testing.T) {
+	probe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer probe.Close()
+	// the first member fails to dial the IPv4 probe from IPv6 local address
+	members := []namedDialer{
+		{name: "a", Dialer: &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv6loopback}}},
+		{name: "b", Dialer: new(net.Dialer)},
+	}
+	g, err := newDialerGroup(config.GroupConfig{
+		Name:        "test",
+		HealthCheck: &config.HealthCheck{URL: probe.URL, Interval: 1, Timeout: 1, Threshold: 2},
+	}, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d transport.Dialer
+	for i := 0; i < 100 && d == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		d, _ = g.choose("example.com:443")
+	}
+	if d != members[1].Dialer {
+		t.Fatal("expected the healthy member")
+	}
+
+	// the member keeps healthy until it fails threshold times in a row
+	g.Close()
+	g.record(1, 5*time.Millisecond, nil)
+	g.record(1, 0, errors.New("timeout"))
+	if g.latency[1] != 5*time.Millisecond {
+		t.Fatalf("got latency %s after one failure, want 5ms", g.latency[1])
+	}
+	g.record(1, 0, errors.New("timeout"))
+	if g.latency[1] >= 0 {
+		t.Fatalf("got latency %s after two failures, want unhealthy", g.latency[1])
+	}
+
+	_, err = newDialerGroup(config.GroupConfig{
+		Name:        "inband",
+		HealthCheck: &config.HealthCheck{URL: config.ProbeInBand},
+	}, members)
+	if err == nil {
+		t.Fatal("expected error for transport without in-band health check")
+	}
+}
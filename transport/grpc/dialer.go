@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/chenen3/yeager/internal/netutil"
 	"github.com/chenen3/yeager/transport"
 	"github.com/chenen3/yeager/transport/grpc/pb"
 	"google.golang.org/grpc"
@@ -23,6 +24,7 @@ import (
 type streamDialer struct {
 	proxyAddress string
 	cfg          *tls.Config
+	base         transport.Dialer // nil means dialing the server directly
 	mu           sync.Mutex
 	conns        []*grpc.ClientConn
 }
@@ -32,8 +34,9 @@ var _ transport.Dialer = (*streamDialer)(nil)
 // NewStreamDialer returns a new transport.StreamDialer that dials
 // through the provided proxy server's address. The caller should
 // call Close when finished, to close the underlying grpc connections.
-func NewStreamDialer(addr string, cfg *tls.Config) *streamDialer {
-	return &streamDialer{proxyAddress: addr, cfg: cfg}
+// If base is not nil, the connections to server are dialed through it.
+func NewStreamDialer(addr string, cfg *tls.Config, base transport.Dialer) *streamDialer {
+	return &streamDialer{proxyAddress: addr, cfg: cfg, base: base}
 }
 
 const keepaliveInterval = 15 * time.Second
@@ -74,6 +77,11 @@ func (d *streamDialer) getConn(ctx context.Context) (*grpc.ClientConn, error) {
 			Timeout: 2 * time.Second,
 		}),
 	}
+	if d.base != nil {
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.base.DialContext(ctx, "tcp", addr)
+		}))
+	}
 	conn, err := grpc.DialContext(ctx, d.proxyAddress, opts...)
 	if err != nil {
 		return nil, err
@@ -85,7 +93,10 @@ func (d *streamDialer) getConn(ctx context.Context) (*grpc.ClientConn, error) {
 	return conn, nil
 }
 
-const addressKey = "address"
+const (
+	addressKey = "address"
+	idKey      = "id" // the ID of connection accepted for reverse tunnel
+)
 
 func (d *streamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	conn, err := d.getConn(ctx)
@@ -106,6 +117,18 @@ func (d *streamDialer) DialContext(ctx context.Context, network, address string)
 	return &clientStream{stream: stream, onClose: cancel}, nil
 }
 
+var _ transport.Prober = (*streamDialer)(nil)
+
+// Probe sends a ping through the connection to server
+func (d *streamDialer) Probe(ctx context.Context) error {
+	conn, err := d.getConn(ctx)
+	if err != nil {
+		return errors.New("grpc connect: " + err.Error())
+	}
+	_, err = pb.NewTunnelClient(conn).Ping(ctx, &pb.Message{})
+	return err
+}
+
 func (c *streamDialer) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -200,15 +223,8 @@ func (c *clientStream) WriteTo(w io.Writer) (written int64, err error) {
 	return written, err
 }
 
-var bufPool = sync.Pool{
-	New: func() any {
-		buf := make([]byte, 16*1024)
-		return &buf
-	},
-}
-
 func (c *clientStream) ReadFrom(r io.Reader) (n int64, err error) {
-	buf := bufPool.Get().(*[]byte)
+	buf := netutil.GetBuffer()
 	for {
 		nr, er := r.Read(*buf)
 		if nr > 0 {
@@ -226,7 +242,7 @@ func (c *clientStream) ReadFrom(r io.Reader) (n int64, err error) {
 			break
 		}
 	}
-	bufPool.Put(buf)
+	netutil.PutBuffer(buf)
 	return n, err
 }
 
@@ -253,3 +269,193 @@ func (c *clientStream) SetWriteDeadline(t time.Time) error {
 	c.writeDeadline = t
 	return nil
 }
+
+// maxDatagramSize is large enough for any UDP payload
+const maxDatagramSize = 64 * 1024
+
+var _ transport.PacketDialer = (*streamDialer)(nil)
+
+// DialPacket returns a connection that carries UDP datagrams to address.
+func (d *streamDialer) DialPacket(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := d.getConn(ctx)
+	if err != nil {
+		return nil, errors.New("grpc connect: " + err.Error())
+	}
+
+	client := pb.NewTunnelClient(conn)
+	// this context controls the lifetime of the stream, do not use short-lived contexts
+	sctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Packet(sctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c := &packetConn{
+		stream:       stream,
+		address:      address,
+		onClose:      cancel,
+		recv:         make(chan *pb.Datagram),
+		recvDone:     make(chan struct{}),
+		done:         make(chan struct{}),
+		readDeadline: newDeadline(),
+	}
+	go c.receive()
+	return c, nil
+}
+
+// packetConn implements net.Conn, each Write sends a datagram
+// and each Read receives a datagram.
+type packetConn struct {
+	stream  pb.Tunnel_PacketClient
+	address string
+	onClose func()
+
+	// the datagrams received in background, so that
+	// the blocking receive can be interrupted by deadline
+	recv     chan *pb.Datagram
+	recvErr  error
+	recvDone chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	readDeadline  *deadline
+	writeDeadline time.Time
+}
+
+var _ net.Conn = (*packetConn)(nil)
+
+func (c *packetConn) receive() {
+	defer close(c.recvDone)
+	for {
+		dg, err := c.stream.Recv()
+		if err != nil {
+			c.recvErr = err
+			return
+		}
+		select {
+		case c.recv <- dg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Read reads a datagram, the excess bytes are discarded if b is too small
+func (c *packetConn) Read(b []byte) (n int, err error) {
+	select {
+	case dg := <-c.recv:
+		return copy(b, dg.Data), nil
+	case <-c.recvDone:
+		if c.recvErr == nil {
+			return 0, net.ErrClosed
+		}
+		return 0, c.recvErr
+	case <-c.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *packetConn) Write(b []byte) (n int, err error) {
+	if !c.writeDeadline.IsZero() && time.Now().After(c.writeDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if err = c.stream.Send(&pb.Datagram{Data: b, Address: c.address}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline = t
+	return nil
+}
+
+// deadline is a channel closed when the time is exceeded,
+// which can be reset to a new time.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline, a zero value for t means no deadline
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// wait for the timer function to close the channel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline is exceeded
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -3,13 +3,16 @@ package grpc
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/chenen3/yeager/config"
 	"github.com/chenen3/yeager/echo"
+	"github.com/chenen3/yeager/internal/transporttest"
 )
 
 func TestTunnel(t *testing.T) {
@@ -25,12 +28,12 @@ func TestTunnel(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ts, err := NewServer(addr, srvTLSConf)
+	ts, err := NewServer(addr, srvTLSConf, false)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer ts.Stop()
-	td := NewStreamDialer(addr, cliTLSConf)
+	td := NewStreamDialer(addr, cliTLSConf, nil)
 	defer td.Close()
 	// the tunnel server may not started yet
 	time.Sleep(time.Millisecond)
@@ -55,6 +58,148 @@ func TestTunnel(t *testing.T) {
 	}
 }
 
+func TestProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	addr := listener.Addr().String()
+	cliTLSConf, srvTLSConf, err := config.MutualTLS("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewServer(addr, srvTLSConf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	td := NewStreamDialer(addr, cliTLSConf, nil)
+	defer td.Close()
+	// the tunnel server may not started yet
+	time.Sleep(time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = td.Probe(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPacket(t *testing.T) {
+	e := echo.NewUDPServer()
+	defer e.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	addr := listener.Addr().String()
+	cliTLSConf, srvTLSConf, err := config.MutualTLS("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewServer(addr, srvTLSConf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	td := NewStreamDialer(addr, cliTLSConf, nil)
+	defer td.Close()
+	// the tunnel server may not started yet
+	time.Sleep(time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := td.DialPacket(ctx, e.PacketConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// nothing to read, the pending read is interrupted
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err = conn.Read(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, want := range [][]byte{{1}, {2, 3}} {
+		if _, err := conn.Write(want); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 16)
+		n, err := conn.Read(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[:n], want) {
+			t.Fatalf("got %v, want %v", got[:n], want)
+		}
+	}
+}
+
+func TestPacketUnknownSource(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	go func() {
+		buf := make([]byte, 16)
+		_, relay, err := target.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// the datagram from other source arrives first
+		other.WriteTo([]byte("other"), relay)
+		time.Sleep(10 * time.Millisecond)
+		target.WriteTo([]byte("target"), relay)
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	addr := listener.Addr().String()
+	cliTLSConf, srvTLSConf, err := config.MutualTLS("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewServer(addr, srvTLSConf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	td := NewStreamDialer(addr, cliTLSConf, nil)
+	defer td.Close()
+	// the tunnel server may not started yet
+	time.Sleep(time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := td.DialPacket(ctx, target.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 16)
+	n, err := conn.Read(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got[:n]) != "target" {
+		t.Fatalf("got %q, want %q", got[:n], "target")
+	}
+}
+
 func BenchmarkThroughput(b *testing.B) {
 	echo := echo.NewServer()
 	defer echo.Close()
@@ -69,12 +214,12 @@ func BenchmarkThroughput(b *testing.B) {
 	if err != nil {
 		b.Fatal(err)
 	}
-	ts, err := NewServer(addr, srvTLSConf)
+	ts, err := NewServer(addr, srvTLSConf, false)
 	if err != nil {
 		b.Fatal(err)
 	}
 	defer ts.Stop()
-	td := NewStreamDialer(addr, cliTLSConf)
+	td := NewStreamDialer(addr, cliTLSConf, nil)
 	defer td.Close()
 	// the tunnel server may not started yet
 	time.Sleep(time.Millisecond)
@@ -109,3 +254,26 @@ func BenchmarkThroughput(b *testing.B) {
 	megabits := 8 * n * b.N / 1e6
 	b.ReportMetric(float64(megabits)/elapsed.Seconds(), "mbps")
 }
+
+func TestReverse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	addr := listener.Addr().String()
+	cliTLSConf, srvTLSConf, err := config.MutualTLS("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewServer(addr, srvTLSConf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Stop()
+	td := NewStreamDialer(addr, cliTLSConf, nil)
+	defer td.Close()
+	// the tunnel server may not started yet
+	time.Sleep(time.Millisecond)
+	transporttest.TestReverse(t, td)
+}
@@ -19,6 +19,16 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type TunnelClient interface {
 	Stream(ctx context.Context, opts ...grpc.CallOption) (Tunnel_StreamClient, error)
+	Packet(ctx context.Context, opts ...grpc.CallOption) (Tunnel_PacketClient, error)
+	// Bind listens on the requested address for reverse tunnel,
+	// streaming the ID of each accepted connection to client.
+	// An empty ID is sent first once the server is listening.
+	Bind(ctx context.Context, in *BindRequest, opts ...grpc.CallOption) (Tunnel_BindClient, error)
+	// Accept claims the accepted connection whose ID is in metadata,
+	// and relays it like Stream.
+	Accept(ctx context.Context, opts ...grpc.CallOption) (Tunnel_AcceptClient, error)
+	// Ping echoes the message, clients measure the tunnel with it.
+	Ping(ctx context.Context, in *Message, opts ...grpc.CallOption) (*Message, error)
 }
 
 type tunnelClient struct {
@@ -60,11 +70,124 @@ func (x *tunnelStreamClient) Recv() (*Message, error) {
 	return m, nil
 }
 
+func (c *tunnelClient) Packet(ctx context.Context, opts ...grpc.CallOption) (Tunnel_PacketClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Tunnel_ServiceDesc.Streams[1], "/pb.Tunnel/Packet", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &tunnelPacketClient{stream}
+	return x, nil
+}
+
+type Tunnel_PacketClient interface {
+	Send(*Datagram) error
+	Recv() (*Datagram, error)
+	grpc.ClientStream
+}
+
+type tunnelPacketClient struct {
+	grpc.ClientStream
+}
+
+func (x *tunnelPacketClient) Send(m *Datagram) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *tunnelPacketClient) Recv() (*Datagram, error) {
+	m := new(Datagram)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *tunnelClient) Bind(ctx context.Context, in *BindRequest, opts ...grpc.CallOption) (Tunnel_BindClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Tunnel_ServiceDesc.Streams[2], "/pb.Tunnel/Bind", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &tunnelBindClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Tunnel_BindClient interface {
+	Recv() (*Incoming, error)
+	grpc.ClientStream
+}
+
+type tunnelBindClient struct {
+	grpc.ClientStream
+}
+
+func (x *tunnelBindClient) Recv() (*Incoming, error) {
+	m := new(Incoming)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *tunnelClient) Accept(ctx context.Context, opts ...grpc.CallOption) (Tunnel_AcceptClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Tunnel_ServiceDesc.Streams[3], "/pb.Tunnel/Accept", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &tunnelAcceptClient{stream}
+	return x, nil
+}
+
+type Tunnel_AcceptClient interface {
+	Send(*Message) error
+	Recv() (*Message, error)
+	grpc.ClientStream
+}
+
+type tunnelAcceptClient struct {
+	grpc.ClientStream
+}
+
+func (x *tunnelAcceptClient) Send(m *Message) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *tunnelAcceptClient) Recv() (*Message, error) {
+	m := new(Message)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *tunnelClient) Ping(ctx context.Context, in *Message, opts ...grpc.CallOption) (*Message, error) {
+	out := new(Message)
+	err := c.cc.Invoke(ctx, "/pb.Tunnel/Ping", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TunnelServer is the server API for Tunnel service.
 // All implementations must embed UnimplementedTunnelServer
 // for forward compatibility
 type TunnelServer interface {
 	Stream(Tunnel_StreamServer) error
+	Packet(Tunnel_PacketServer) error
+	// Bind listens on the requested address for reverse tunnel,
+	// streaming the ID of each accepted connection to client.
+	// An empty ID is sent first once the server is listening.
+	Bind(*BindRequest, Tunnel_BindServer) error
+	// Accept claims the accepted connection whose ID is in metadata,
+	// and relays it like Stream.
+	Accept(Tunnel_AcceptServer) error
+	// Ping echoes the message, clients measure the tunnel with it.
+	Ping(context.Context, *Message) (*Message, error)
 	mustEmbedUnimplementedTunnelServer()
 }
 
@@ -75,6 +198,18 @@ type UnimplementedTunnelServer struct {
 func (UnimplementedTunnelServer) Stream(Tunnel_StreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
 }
+func (UnimplementedTunnelServer) Packet(Tunnel_PacketServer) error {
+	return status.Errorf(codes.Unimplemented, "method Packet not implemented")
+}
+func (UnimplementedTunnelServer) Bind(*BindRequest, Tunnel_BindServer) error {
+	return status.Errorf(codes.Unimplemented, "method Bind not implemented")
+}
+func (UnimplementedTunnelServer) Accept(Tunnel_AcceptServer) error {
+	return status.Errorf(codes.Unimplemented, "method Accept not implemented")
+}
+func (UnimplementedTunnelServer) Ping(context.Context, *Message) (*Message, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ping not implemented")
+}
 func (UnimplementedTunnelServer) mustEmbedUnimplementedTunnelServer() {}
 
 // UnsafeTunnelServer may be embedded to opt out of forward compatibility for this service.
@@ -114,13 +249,109 @@ func (x *tunnelStreamServer) Recv() (*Message, error) {
 	return m, nil
 }
 
+func _Tunnel_Packet_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TunnelServer).Packet(&tunnelPacketServer{stream})
+}
+
+type Tunnel_PacketServer interface {
+	Send(*Datagram) error
+	Recv() (*Datagram, error)
+	grpc.ServerStream
+}
+
+type tunnelPacketServer struct {
+	grpc.ServerStream
+}
+
+func (x *tunnelPacketServer) Send(m *Datagram) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *tunnelPacketServer) Recv() (*Datagram, error) {
+	m := new(Datagram)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Tunnel_Bind_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BindRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TunnelServer).Bind(m, &tunnelBindServer{stream})
+}
+
+type Tunnel_BindServer interface {
+	Send(*Incoming) error
+	grpc.ServerStream
+}
+
+type tunnelBindServer struct {
+	grpc.ServerStream
+}
+
+func (x *tunnelBindServer) Send(m *Incoming) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Tunnel_Accept_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TunnelServer).Accept(&tunnelAcceptServer{stream})
+}
+
+type Tunnel_AcceptServer interface {
+	Send(*Message) error
+	Recv() (*Message, error)
+	grpc.ServerStream
+}
+
+type tunnelAcceptServer struct {
+	grpc.ServerStream
+}
+
+func (x *tunnelAcceptServer) Send(m *Message) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *tunnelAcceptServer) Recv() (*Message, error) {
+	m := new(Message)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Tunnel_Ping_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Message)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TunnelServer).Ping(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Tunnel/Ping",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TunnelServer).Ping(ctx, req.(*Message))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Tunnel_ServiceDesc is the grpc.ServiceDesc for Tunnel service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var Tunnel_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "pb.Tunnel",
 	HandlerType: (*TunnelServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Ping",
+			Handler:    _Tunnel_Ping_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "Stream",
@@ -128,6 +359,23 @@ var Tunnel_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "Packet",
+			Handler:       _Tunnel_Packet_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Bind",
+			Handler:       _Tunnel_Bind_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Accept",
+			Handler:       _Tunnel_Accept_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "tunnel.proto",
 }
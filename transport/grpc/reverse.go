@@ -0,0 +1,80 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/chenen3/yeager/transport"
+	"github.com/chenen3/yeager/transport/grpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+var _ transport.RemoteListener = (*streamDialer)(nil)
+
+// Listen asks the server to listen on address for reverse tunnel,
+// the returned listener lives until it is closed or the grpc
+// connection is broken.
+func (d *streamDialer) Listen(ctx context.Context, address string) (net.Listener, error) {
+	conn, err := d.getConn(ctx)
+	if err != nil {
+		return nil, errors.New("grpc connect: " + err.Error())
+	}
+
+	client := pb.NewTunnelClient(conn)
+	// this context controls the lifetime of the listener
+	lctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Bind(lctx, &pb.BindRequest{Address: address})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// wait until the server is listening
+	if _, err = stream.Recv(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return &remoteListener{conn: conn, stream: stream, address: address, cancel: cancel}, nil
+}
+
+// remoteListener implements net.Listener, each Accept claims
+// a connection accepted by server
+type remoteListener struct {
+	conn    *grpc.ClientConn
+	stream  pb.Tunnel_BindClient
+	address string
+	cancel  context.CancelFunc
+	once    sync.Once
+}
+
+func (l *remoteListener) Accept() (net.Conn, error) {
+	in, err := l.stream.Recv()
+	if err != nil {
+		if l.stream.Context().Err() != nil {
+			return nil, net.ErrClosed
+		}
+		return nil, err
+	}
+
+	client := pb.NewTunnelClient(l.conn)
+	// this context controls the lifetime of the stream, do not use short-lived contexts
+	sctx, cancel := context.WithCancel(context.Background())
+	sctx = metadata.NewOutgoingContext(sctx, metadata.Pairs(idKey, in.Id))
+	stream, err := client.Accept(sctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &clientStream{stream: stream, onClose: cancel}, nil
+}
+
+func (l *remoteListener) Close() error {
+	l.once.Do(l.cancel)
+	return nil
+}
+
+func (l *remoteListener) Addr() net.Addr {
+	return transport.RemoteAddr(l.address)
+}
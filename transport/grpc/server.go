@@ -1,25 +1,33 @@
 package grpc
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
 	"net"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/chenen3/yeager/internal/netutil"
 	"github.com/chenen3/yeager/logger"
+	"github.com/chenen3/yeager/transport"
 	"github.com/chenen3/yeager/transport/grpc/pb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 const idleTimeout = 10 * time.Minute
 
 // NewServer starts a gRPC server for forword proxy.
+// If reverse is true, clients are allowed to listen on the server for reverse tunnel.
 // The caller should call Stop when finished.
-func NewServer(addr string, config *tls.Config) (*grpc.Server, error) {
+func NewServer(addr string, config *tls.Config, reverse bool) (*grpc.Server, error) {
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
@@ -33,7 +41,11 @@ func NewServer(addr string, config *tls.Config) (*grpc.Server, error) {
 			MinTime: keepaliveInterval,
 		}),
 	)
-	pb.RegisterTunnelServer(s, service{})
+	var svc service
+	if reverse {
+		svc.reverse = transport.NewReverseServer()
+	}
+	pb.RegisterTunnelServer(s, svc)
 	go func() {
 		err := s.Serve(listener)
 		if err != nil {
@@ -45,6 +57,7 @@ func NewServer(addr string, config *tls.Config) (*grpc.Server, error) {
 
 type service struct {
 	pb.UnimplementedTunnelServer
+	reverse *transport.ReverseServer // nil if reverse tunnel is disabled
 }
 
 func (service) Stream(stream pb.Tunnel_StreamServer) error {
@@ -72,6 +85,126 @@ func (service) Stream(stream pb.Tunnel_StreamServer) error {
 	return nil
 }
 
+func (service) Ping(ctx context.Context, m *pb.Message) (*pb.Message, error) {
+	return m, nil
+}
+
+func (s service) Bind(req *pb.BindRequest, stream pb.Tunnel_BindServer) error {
+	if s.reverse == nil {
+		return status.Error(codes.PermissionDenied, "reverse tunnel is disabled")
+	}
+	lis, err := net.Listen("tcp", req.Address)
+	if err != nil {
+		return err
+	}
+	logger.Info.Printf("reverse tunnel listen on %s", lis.Addr())
+	defer logger.Info.Printf("reverse tunnel close %s", lis.Addr())
+	// tell the client it is ready
+	if err = stream.Send(&pb.Incoming{}); err != nil {
+		lis.Close()
+		return err
+	}
+	return s.reverse.Serve(stream.Context(), lis, func(id string) error {
+		return stream.Send(&pb.Incoming{Id: id})
+	})
+}
+
+func (s service) Accept(stream pb.Tunnel_AcceptServer) error {
+	if s.reverse == nil {
+		return status.Error(codes.PermissionDenied, "reverse tunnel is disabled")
+	}
+	v := metadata.ValueFromIncomingContext(stream.Context(), idKey)
+	if len(v) == 0 {
+		return errors.New("missing connection ID")
+	}
+	conn, ok := s.reverse.Claim(v[0])
+	if !ok {
+		return transport.ErrUnknownID
+	}
+	defer conn.Close()
+
+	ss := serverStream{stream}
+	go func() {
+		ss.WriteTo(conn)
+		if cw, ok := conn.(*net.TCPConn); ok {
+			cw.CloseWrite()
+		}
+	}()
+	ss.ReadFrom(conn)
+	return nil
+}
+
+// udpIdleTimeout is how long the packet stream lives without receiving any datagram
+const udpIdleTimeout = 2 * time.Minute
+
+func (service) Packet(stream pb.Tunnel_PacketServer) error {
+	if stream.Context().Err() != nil {
+		return stream.Context().Err()
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	pc.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+
+	// the destinations that client has sent to, datagrams
+	// from other sources must not be injected into the session
+	var mu sync.Mutex
+	peers := make(map[string]bool)
+	go func() {
+		// unblock the reading of pc
+		defer pc.Close()
+		// resolve each destination only once
+		resolved := make(map[string]*net.UDPAddr)
+		for {
+			dg, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			addr, ok := resolved[dg.Address]
+			if !ok {
+				addr, err = net.ResolveUDPAddr("udp", dg.Address)
+				if err != nil {
+					logger.Debug.Printf("resolve %s: %s", dg.Address, err)
+					continue
+				}
+				resolved[dg.Address] = addr
+				mu.Lock()
+				peers[addr.String()] = true
+				mu.Unlock()
+			}
+			if _, err = pc.WriteTo(dg.Data, addr); err != nil {
+				logger.Debug.Printf("write udp: %s", err)
+				continue
+			}
+			pc.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil
+			}
+			return err
+		}
+		mu.Lock()
+		known := peers[addr.String()]
+		mu.Unlock()
+		if !known {
+			logger.Debug.Printf("drop udp from unknown source %s", addr)
+			continue
+		}
+		pc.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		if err = stream.Send(&pb.Datagram{Data: buf[:n], Address: addr.String()}); err != nil {
+			return err
+		}
+	}
+}
+
 // serverStream implements io.WriterTo and io.ReaderFrom as optimizations
 // so copying to or from it can avoid allocating unnecessary buffers.
 type serverStream struct {
@@ -115,7 +248,7 @@ func (ss serverStream) WriteTo(w io.Writer) (written int64, err error) {
 }
 
 func (ss serverStream) ReadFrom(r io.Reader) (n int64, err error) {
-	buf := bufPool.Get().(*[]byte)
+	buf := netutil.GetBuffer()
 	for {
 		nr, er := r.Read(*buf)
 		if nr > 0 {
@@ -133,6 +266,6 @@ func (ss serverStream) ReadFrom(r io.Reader) (n int64, err error) {
 			break
 		}
 	}
-	bufPool.Put(buf)
+	netutil.PutBuffer(buf)
 	return n, err
 }
@@ -3,17 +3,14 @@ package http2
 import (
 	"context"
 	"crypto/tls"
-	"encoding/base64"
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"os"
-	"sync"
 	"time"
 
+	"github.com/chenen3/yeager/internal/netutil"
 	"github.com/chenen3/yeager/transport"
 )
 
@@ -27,22 +24,25 @@ type dialer struct {
 var _ transport.Dialer = (*dialer)(nil)
 
 // NewStreamDialer returns a new transport.StreamDialer that dials through the provided
-// proxy server's address.
-func NewStreamDialer(addr string, cfg *tls.Config, username, password string) *dialer {
+// proxy server's address. If base is not nil, the connections to server are dialed through it.
+func NewStreamDialer(addr string, cfg *tls.Config, username, password string, base transport.Dialer) *dialer {
 	d := &dialer{
 		proxyAddr: addr,
 		username:  username,
 		password:  password,
 	}
 
+	if base == nil {
+		base = &net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+	}
 	// mitigate website fingerprinting via multiplexing of HTTP/2 ,
 	// the fewer connections the better
 	d.client = &http.Client{
 		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   10 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
+			DialContext:         base.DialContext,
 			TLSClientConfig:     cfg,
 			ForceAttemptHTTP2:   true,
 			MaxIdleConns:        100,
@@ -53,27 +53,44 @@ func NewStreamDialer(addr string, cfg *tls.Config, username, password string) *d
 	return d
 }
 
-func basicAuth(username, password string) string {
-	auth := username + ":" + password
-	return base64.StdEncoding.EncodeToString([]byte(auth))
-}
-
 func (d *dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	pr, pw := io.Pipe()
-	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, "https://"+d.proxyAddr, pr)
+	return d.connect(ctx, address, "")
+}
+
+// connect sends CONNECT request to address, the reverse header
+// carries the connection ID to claim for reverse tunnel if not empty.
+func (d *dialer) connect(ctx context.Context, address, reverse string) (net.Conn, error) {
+	// this context controls the lifetime of the stream, while ctx
+	// only limits the connecting, e.g. grpc cancels ctx of its dialer
+	// after handshake when chained through this transport
+	sctx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+	// the request body is one end of pipe, which supports write deadline
+	body, w := net.Pipe()
+	req, err := http.NewRequestWithContext(sctx, http.MethodConnect, "https://"+d.proxyAddr, body)
 	if err != nil {
+		cancel()
+		w.Close()
 		return nil, err
 	}
 	req.Host = address
 	if d.username != "" {
-		req.Header.Set("Proxy-Authorization", "Basic "+basicAuth(d.username, d.password))
+		req.Header.Set("Proxy-Authorization", netutil.BasicAuth(d.username, d.password))
+	}
+	if reverse != "" {
+		req.Header.Set(reverseHeader, reverse)
 	}
 
 	resp, err := d.client.Do(req)
 	if err != nil {
+		cancel()
+		w.Close()
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer w.Close()
 		defer resp.Body.Close()
 		dump, err := httputil.DumpResponse(resp, true)
 		if err != nil {
@@ -81,7 +98,36 @@ func (d *dialer) DialContext(ctx context.Context, network, address string) (net.
 		}
 		return nil, fmt.Errorf("failed to connect, response: %q", dump)
 	}
-	return &stream{writer: pw, reader: resp.Body}, nil
+	// the blocking read of response body can not be interrupted,
+	// copy it to a pipe which supports read deadline
+	r, rw := net.Pipe()
+	go func() {
+		io.Copy(rw, resp.Body)
+		rw.Close()
+	}()
+	return &stream{writer: w, reader: r, body: resp.Body, onClose: cancel}, nil
+}
+
+var _ transport.Prober = (*dialer)(nil)
+
+// Probe requests the health endpoint of server
+func (d *dialer) Probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+d.proxyAddr+healthPath, nil)
+	if err != nil {
+		return err
+	}
+	if d.username != "" {
+		req.Header.Set("Proxy-Authorization", netutil.BasicAuth(d.username, d.password))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+	return nil
 }
 
 func (d *dialer) Close() error {
@@ -89,31 +135,30 @@ func (d *dialer) Close() error {
 	return nil
 }
 
+// stream is the connection over the request and response body of HTTP CONNECT
 type stream struct {
-	writer *io.PipeWriter
-	reader io.ReadCloser
-
-	writeDeadline time.Time
-	readDeadline  time.Time
+	writer  net.Conn // the peer is request body
+	reader  net.Conn // the peer is fed by response body
+	body    io.ReadCloser
+	onClose func()
 }
 
 func (s *stream) Read(p []byte) (n int, err error) {
-	if !s.readDeadline.IsZero() && time.Now().After(s.readDeadline) {
-		return 0, os.ErrDeadlineExceeded
-	}
 	return s.reader.Read(p)
 }
 
 func (s *stream) Write(p []byte) (n int, err error) {
-	if !s.writeDeadline.IsZero() && time.Now().After(s.writeDeadline) {
-		return 0, os.ErrDeadlineExceeded
-	}
 	return s.writer.Write(p)
 }
 
 func (s *stream) Close() error {
 	s.writer.Close()
-	return s.reader.Close()
+	s.reader.Close()
+	err := s.body.Close()
+	if s.onClose != nil {
+		s.onClose()
+	}
+	return err
 }
 
 func (s *stream) CloseWrite() error {
@@ -121,27 +166,24 @@ func (s *stream) CloseWrite() error {
 }
 
 func (s *stream) ReadFrom(r io.Reader) (n int64, err error) {
-	return bufferedCopy(s.writer, r)
+	return netutil.Copy(s.writer, r)
 }
 
 func (s *stream) WriteTo(w io.Writer) (written int64, err error) {
-	return bufferedCopy(w, s.reader)
+	return netutil.Copy(w, s.reader)
 }
 
 func (s *stream) SetDeadline(t time.Time) error {
-	s.readDeadline = t
-	s.writeDeadline = t
-	return nil
+	s.reader.SetReadDeadline(t)
+	return s.writer.SetWriteDeadline(t)
 }
 
 func (s *stream) SetReadDeadline(t time.Time) error {
-	s.readDeadline = t
-	return nil
+	return s.reader.SetReadDeadline(t)
 }
 
 func (s *stream) SetWriteDeadline(t time.Time) error {
-	s.writeDeadline = t
-	return nil
+	return s.writer.SetWriteDeadline(t)
 }
 
 func (s *stream) LocalAddr() net.Addr {
@@ -151,45 +193,3 @@ func (s *stream) LocalAddr() net.Addr {
 func (s *stream) RemoteAddr() net.Addr {
 	return nil
 }
-
-var bufPool = sync.Pool{
-	New: func() any {
-		// refer to 16KB maxPlaintext in crypto/tls/common.go
-		b := make([]byte, 16*1024)
-		return &b
-	},
-}
-
-// copy data from src to dst using buffer pool
-func bufferedCopy(dst io.Writer, src io.Reader) (written int64, err error) {
-	buf := bufPool.Get().(*[]byte)
-	for {
-		nr, er := src.Read(*buf)
-		if nr > 0 {
-			nw, ew := dst.Write((*buf)[0:nr])
-			if nw < 0 || nr < nw {
-				nw = 0
-				if ew == nil {
-					ew = errors.New("invalid write result")
-				}
-			}
-			written += int64(nw)
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
-		}
-		if er != nil {
-			if er != io.EOF {
-				err = er
-			}
-			break
-		}
-	}
-	bufPool.Put(buf)
-	return written, err
-}
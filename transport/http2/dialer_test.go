@@ -3,14 +3,17 @@ package http2
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/chenen3/yeager/config"
 	"github.com/chenen3/yeager/echo"
+	"github.com/chenen3/yeager/internal/transporttest"
 )
 
 func run() (*http.Server, *dialer, error) {
@@ -24,11 +27,11 @@ func run() (*http.Server, *dialer, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	ts, err := NewServer(lis.Addr().String(), srvTLSConf, "", "")
+	ts, err := NewServer(lis.Addr().String(), srvTLSConf, "", "", false)
 	if err != nil {
 		return nil, nil, err
 	}
-	td := NewStreamDialer(lis.Addr().String(), cliTLSConf, "", "")
+	td := NewStreamDialer(lis.Addr().String(), cliTLSConf, "", "", nil)
 	return ts, td, nil
 }
 
@@ -84,13 +87,13 @@ func TestAuth(t *testing.T) {
 	}
 
 	user, pass := "u", "p"
-	ts, err := NewServer(lis.Addr().String(), srvTLSConf, user, pass)
+	ts, err := NewServer(lis.Addr().String(), srvTLSConf, user, pass, false)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer ts.Close()
 
-	td := NewStreamDialer(lis.Addr().String(), cliTLSConf, user, pass)
+	td := NewStreamDialer(lis.Addr().String(), cliTLSConf, user, pass, nil)
 	defer td.Close()
 
 	time.Sleep(time.Millisecond * 100)
@@ -134,13 +137,13 @@ func TestBadAuth(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	ts, err := NewServer(lis.Addr().String(), srvTLSConf, "u", "p")
+	ts, err := NewServer(lis.Addr().String(), srvTLSConf, "u", "p", false)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer ts.Close()
 
-	td := NewStreamDialer(lis.Addr().String(), cliTLSConf, "fakeuser", "fakepass")
+	td := NewStreamDialer(lis.Addr().String(), cliTLSConf, "fakeuser", "fakepass", nil)
 	defer td.Close()
 
 	time.Sleep(time.Millisecond * 100)
@@ -150,8 +153,11 @@ func TestBadAuth(t *testing.T) {
 	if err == nil {
 		t.Fatalf("expected error for mismatch auth")
 	}
+	if err = td.Probe(ctx); err == nil {
+		t.Fatalf("expected probe error for mismatch auth")
+	}
 
-	td2 := NewStreamDialer(lis.Addr().String(), cliTLSConf, "", "")
+	td2 := NewStreamDialer(lis.Addr().String(), cliTLSConf, "", "", nil)
 	defer td2.Close()
 	time.Sleep(time.Millisecond * 100)
 	_, err = td2.DialContext(ctx, "tcp", es.Listener.Addr().String())
@@ -160,6 +166,22 @@ func TestBadAuth(t *testing.T) {
 	}
 }
 
+func TestProbe(t *testing.T) {
+	ts, td, err := run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	defer td.Close()
+
+	time.Sleep(time.Millisecond * 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = td.Probe(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func BenchmarkThroughput(b *testing.B) {
 	es := echo.NewServer()
 	defer es.Close()
@@ -203,3 +225,64 @@ func BenchmarkThroughput(b *testing.B) {
 	megabits := 8 * n * b.N / 1e6
 	b.ReportMetric(float64(megabits)/elapsed.Seconds(), "mbps")
 }
+
+func TestStreamDeadline(t *testing.T) {
+	e := echo.NewServer()
+	defer e.Close()
+	ts, td, err := run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	defer td.Close()
+
+	time.Sleep(time.Millisecond * 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream, err := td.DialContext(ctx, "tcp", e.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	// nothing to read, the pending read is interrupted
+	stream.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	got := make([]byte, 1)
+	if _, err = stream.Read(got); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// the stream is still usable after extending the deadline
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+	want := []byte{1}
+	if _, err = stream.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(stream, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.Close()
+	cliTLSConf, srvTLSConf, err := config.MutualTLS("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := NewServer(lis.Addr().String(), srvTLSConf, "", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	td := NewStreamDialer(lis.Addr().String(), cliTLSConf, "", "", nil)
+	defer td.Close()
+	time.Sleep(time.Millisecond * 100)
+	transporttest.TestReverse(t, td)
+}
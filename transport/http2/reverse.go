@@ -0,0 +1,99 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+
+	"github.com/chenen3/yeager/internal/netutil"
+	"github.com/chenen3/yeager/transport"
+)
+
+var _ transport.RemoteListener = (*dialer)(nil)
+
+// Listen asks the server to listen on address for reverse tunnel,
+// the returned listener lives until it is closed or the connection
+// to server is broken.
+func (d *dialer) Listen(ctx context.Context, address string) (net.Listener, error) {
+	// this context controls the lifetime of the listener
+	lctx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(lctx, http.MethodConnect, "https://"+d.proxyAddr, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Host = address
+	req.Header.Set(reverseHeader, "bind")
+	if d.username != "" {
+		req.Header.Set("Proxy-Authorization", netutil.BasicAuth(d.username, d.password))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer resp.Body.Close()
+		dump, err := httputil.DumpResponse(resp, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen, status code: %s", resp.Status)
+		}
+		return nil, fmt.Errorf("failed to listen, response: %q", dump)
+	}
+	return &remoteListener{
+		dialer:  d,
+		address: address,
+		body:    resp.Body,
+		reader:  bufio.NewReader(resp.Body),
+		cancel: func() {
+			pw.Close()
+			cancel()
+		},
+	}, nil
+}
+
+// remoteListener implements net.Listener, each Accept claims
+// a connection accepted by server
+type remoteListener struct {
+	dialer  *dialer
+	address string
+	body    io.ReadCloser
+	reader  *bufio.Reader
+	cancel  func()
+	closed  atomic.Bool
+}
+
+func (l *remoteListener) Accept() (net.Conn, error) {
+	line, err := l.reader.ReadString('\n')
+	if err != nil {
+		if l.closed.Load() {
+			return nil, net.ErrClosed
+		}
+		return nil, err
+	}
+	id := strings.TrimSpace(line)
+	return l.dialer.connect(context.Background(), l.address, id)
+}
+
+func (l *remoteListener) Close() error {
+	if l.closed.Swap(true) {
+		return nil
+	}
+	l.cancel()
+	return l.body.Close()
+}
+
+func (l *remoteListener) Addr() net.Addr {
+	return transport.RemoteAddr(l.address)
+}
@@ -3,17 +3,21 @@ package http2
 import (
 	"crypto/subtle"
 	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/chenen3/yeager/internal/netutil"
 	"github.com/chenen3/yeager/logger"
+	"github.com/chenen3/yeager/transport"
 )
 
 // NewServer starts a HTTP/2 Server for forward proxying.
+// If reverse is true, clients are allowed to listen on the server for reverse tunnel.
 // The caller should call Close when finished.
-func NewServer(addr string, cfg *tls.Config, username, password string) (*http.Server, error) {
+func NewServer(addr string, cfg *tls.Config, username, password string, reverse bool) (*http.Server, error) {
 	cfg.NextProtos = []string{"h2"}
 	lis, err := tls.Listen("tcp", addr, cfg)
 	if err != nil {
@@ -22,7 +26,10 @@ func NewServer(addr string, cfg *tls.Config, username, password string) (*http.S
 
 	var h handler
 	if username != "" {
-		h.auth = []byte("Basic " + basicAuth(username, password))
+		h.auth = []byte(netutil.BasicAuth(username, password))
+	}
+	if reverse {
+		h.reverse = transport.NewReverseServer()
 	}
 	s := &http.Server{
 		Handler:     h,
@@ -37,8 +44,18 @@ func NewServer(addr string, cfg *tls.Config, username, password string) (*http.S
 	return s, nil
 }
 
+// reverseHeader is the header of CONNECT request for reverse tunnel,
+// value "bind" asks the server to listen on the host of request and
+// respond with the ID of each accepted connection per line, otherwise
+// the value is the ID of accepted connection to claim.
+const reverseHeader = "Reverse-Tunnel"
+
+// healthPath answers health checks of authenticated clients
+const healthPath = "/health"
+
 type handler struct {
-	auth []byte
+	auth    []byte
+	reverse *transport.ReverseServer // nil if reverse tunnel is disabled
 }
 
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -46,14 +63,6 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusHTTPVersionNotSupported)
 		return
 	}
-	if r.Method != http.MethodConnect {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-	if r.Host == "" {
-		http.Error(w, "missing host", http.StatusBadRequest)
-		return
-	}
 	if len(h.auth) != 0 {
 		auth := r.Header.Get("Proxy-Authorization")
 		prefix := "Basic "
@@ -63,6 +72,23 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if r.Method == http.MethodGet && r.URL.Path == healthPath {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Host == "" {
+		http.Error(w, "missing host", http.StatusBadRequest)
+		return
+	}
+
+	if v := r.Header.Get(reverseHeader); v != "" {
+		h.serveReverse(w, r, v)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	// client is waiting for response header
@@ -75,12 +101,59 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		logger.Error.Print(err)
 		return
 	}
+	relay(w, r, conn)
+}
+
+// relay copies data between the request stream and conn, closing conn when finished
+func relay(w http.ResponseWriter, r *http.Request, conn net.Conn) {
 	defer conn.Close()
 	go func() {
-		bufferedCopy(conn, r.Body)
-		conn.(*net.TCPConn).CloseWrite()
+		netutil.Copy(conn, r.Body)
+		if cw, ok := conn.(*net.TCPConn); ok {
+			cw.CloseWrite()
+		}
 	}()
-	bufferedCopy(flushWriter{w}, conn)
+	netutil.Copy(flushWriter{w}, conn)
+}
+
+func (h handler) serveReverse(w http.ResponseWriter, r *http.Request, value string) {
+	if h.reverse == nil {
+		http.Error(w, "reverse tunnel is disabled", http.StatusForbidden)
+		return
+	}
+	if value != "bind" {
+		conn, ok := h.reverse.Claim(value)
+		if !ok {
+			http.Error(w, transport.ErrUnknownID.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		relay(w, r, conn)
+		return
+	}
+
+	lis, err := net.Listen("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	logger.Info.Printf("reverse tunnel listen on %s", lis.Addr())
+	defer logger.Info.Printf("reverse tunnel close %s", lis.Addr())
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	fw := flushWriter{w}
+	err = h.reverse.Serve(r.Context(), lis, func(id string) error {
+		_, err := io.WriteString(fw, id+"\n")
+		return err
+	})
+	if err != nil {
+		logger.Error.Printf("reverse tunnel: %s", err)
+	}
 }
 
 type flushWriter struct {
@@ -3,48 +3,129 @@ package https
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
+	"time"
+
+	"github.com/chenen3/yeager/internal/netutil"
+	"github.com/chenen3/yeager/transport"
 )
 
 // dialer establish a tunnel with HTTP CONNECT.
 type dialer struct {
 	proxyAddr string
+	cfg       *tls.Config
+	auth      string
+	base      transport.Dialer
 }
 
-func NewDialer(proxyAddr string) *dialer {
-	return &dialer{proxyAddr: proxyAddr}
+var _ transport.Dialer = (*dialer)(nil)
+
+// NewDialer returns a new transport.StreamDialer that dials through the
+// HTTP proxy. If cfg is not nil, it connects to the proxy over TLS.
+// If username is not empty, the request carries the Basic Proxy-Authorization.
+// If base is not nil, the connections to proxy are dialed through it.
+func NewDialer(proxyAddr string, cfg *tls.Config, username, password string, base transport.Dialer) *dialer {
+	if base == nil {
+		base = new(net.Dialer)
+	}
+	d := &dialer{proxyAddr: proxyAddr, cfg: cfg, base: base}
+	if username != "" {
+		d.auth = netutil.BasicAuth(username, password)
+	}
+	return d
 }
 
 func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	proxyConn, err := net.Dial("tcp", d.proxyAddr)
+	proxyConn, err := d.base.DialContext(ctx, "tcp", d.proxyAddr)
 	if err != nil {
 		return nil, err
 	}
+	if d.cfg != nil {
+		cfg := d.cfg
+		if cfg.ServerName == "" {
+			host, _, err := net.SplitHostPort(d.proxyAddr)
+			if err != nil {
+				proxyConn.Close()
+				return nil, err
+			}
+			cfg = cfg.Clone()
+			cfg.ServerName = host
+		}
+		tlsConn := tls.Client(proxyConn, cfg)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			proxyConn.Close()
+			return nil, err
+		}
+		proxyConn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		proxyConn.SetDeadline(deadline)
+	}
+	// interrupt the handshake when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		proxyConn.SetDeadline(time.Unix(1, 0))
+	})
+	conn, err := d.connect(proxyConn, addr)
+	if !stop() {
+		proxyConn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		proxyConn.Close()
+		return nil, err
+	}
+	proxyConn.SetDeadline(time.Time{})
+	return conn, nil
+}
 
+func (d *dialer) connect(proxyConn net.Conn, addr string) (net.Conn, error) {
 	req, err := http.NewRequest(http.MethodConnect, "http://"+addr, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Host = addr
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
 
 	err = req.Write(proxyConn)
 	if err != nil {
-		proxyConn.Close()
 		return nil, err
 	}
 
-	resp, err := http.ReadResponse(bufio.NewReader(proxyConn), req)
+	br := bufio.NewReader(proxyConn)
+	resp, err := http.ReadResponse(br, req)
 	if err != nil {
-		proxyConn.Close()
 		return nil, err
 	}
 	resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		proxyConn.Close()
 		return nil, fmt.Errorf("proxy connection failed with status code %d", resp.StatusCode)
 	}
+	if br.Buffered() > 0 {
+		// the proxy may send data right after the response header
+		return &bufferedConn{Conn: proxyConn, r: br}, nil
+	}
 	return proxyConn, nil
 }
+
+// bufferedConn reads the bytes buffered by the reader before the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
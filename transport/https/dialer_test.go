@@ -0,0 +1,98 @@
+package https
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/chenen3/yeager/config"
+	"github.com/chenen3/yeager/echo"
+	"github.com/chenen3/yeager/proxy"
+)
+
+func TestDialer(t *testing.T) {
+	e := echo.NewServer()
+	defer e.Close()
+	cliTLSConf, srvTLSConf, err := config.MutualTLS("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", srvTLSConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http.Server{Handler: proxy.NewHTTPHandler(new(net.Dialer), "u", "p")}
+	go s.Serve(lis)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, d := range []*dialer{
+		NewDialer(lis.Addr().String(), cliTLSConf, "u", "x", nil),
+		NewDialer(lis.Addr().String(), nil, "u", "p", nil),
+	} {
+		if conn, err := d.DialContext(ctx, "tcp", e.Listener.Addr().String()); err == nil {
+			conn.Close()
+			t.Fatalf("expected error for TLS %t, auth %s", d.cfg != nil, d.auth)
+		}
+	}
+
+	conn, err := NewDialer(lis.Addr().String(), cliTLSConf, "u", "p", nil).DialContext(ctx, "tcp", e.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	want := "1"
+	if _, err = conn.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestDialerBuffered(t *testing.T) {
+	// the proxy sends data along with the response header
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err = http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\nhello")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := NewDialer(lis.Addr().String(), nil, "", "", nil).DialContext(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("got %q, want %q", got, "hello")
+	}
+}
@@ -0,0 +1,129 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chenen3/yeager/internal/socksaddr"
+	"github.com/chenen3/yeager/transport"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// nextProto is the ALPN protocol of QUIC transport
+const nextProto = "yeager"
+
+const (
+	keepaliveInterval = 15 * time.Second
+	idleTimeout       = 10 * time.Minute
+)
+
+type streamDialer struct {
+	addr string
+	cfg  *tls.Config
+
+	mu   sync.Mutex
+	conn quicgo.Connection
+}
+
+var _ transport.Dialer = (*streamDialer)(nil)
+
+// NewStreamDialer returns a new transport.StreamDialer that dials through
+// the QUIC server, each stream is a QUIC stream of the shared connection.
+// The caller should call Close when finished.
+func NewStreamDialer(addr string, cfg *tls.Config) *streamDialer {
+	cfg = cfg.Clone()
+	cfg.NextProtos = []string{nextProto}
+	return &streamDialer{addr: addr, cfg: cfg}
+}
+
+// getConn returns the existing QUIC connection, dialing a new one if it is closed
+func (d *streamDialer) getConn(ctx context.Context) (quicgo.Connection, error) {
+	d.mu.Lock()
+	if d.conn != nil && d.conn.Context().Err() == nil {
+		d.mu.Unlock()
+		return d.conn, nil
+	}
+	d.mu.Unlock()
+
+	// do not hold the lock while dialing, which may take long
+	conn, err := quicgo.DialAddr(ctx, d.addr, d.cfg, &quicgo.Config{
+		KeepAlivePeriod: keepaliveInterval,
+		MaxIdleTimeout:  idleTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil && d.conn.Context().Err() == nil {
+		// another dial has completed first, share its connection
+		conn.CloseWithError(0, "")
+		return d.conn, nil
+	}
+	d.conn = conn
+	return conn, nil
+}
+
+func (d *streamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	header, err := socksaddr.Append(nil, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.getConn(ctx)
+	if err != nil {
+		return nil, errors.New("quic connect: " + err.Error())
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the destination address in SOCKS form precedes data
+	if _, err = stream.Write(header); err != nil {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		return nil, err
+	}
+	return &streamConn{Stream: stream, local: conn.LocalAddr(), remote: conn.RemoteAddr()}, nil
+}
+
+func (d *streamDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn != nil {
+		return d.conn.CloseWithError(0, "")
+	}
+	return nil
+}
+
+// streamConn implements net.Conn over QUIC stream
+type streamConn struct {
+	quicgo.Stream
+	local  net.Addr
+	remote net.Addr
+}
+
+var _ net.Conn = (*streamConn)(nil)
+
+// Close aborts both directions of stream
+func (c *streamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// CloseWrite closes the write-direction of stream
+func (c *streamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
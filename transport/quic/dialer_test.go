@@ -0,0 +1,103 @@
+package quic
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chenen3/yeager/config"
+	"github.com/chenen3/yeager/echo"
+)
+
+func TestQUIC(t *testing.T) {
+	e := echo.NewServer()
+	defer e.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+	addr := pc.LocalAddr().String()
+	cliTLSConf, srvTLSConf, err := config.MutualTLS("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(addr, srvTLSConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	d := NewStreamDialer(addr, cliTLSConf)
+	defer d.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	// streams share the same connection
+	for i := 0; i < 2; i++ {
+		stream, err := d.DialContext(ctx, "tcp", e.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.SetDeadline(time.Now().Add(time.Second))
+		want := []byte{1, 2, 3}
+		got := make([]byte, len(want))
+		if _, err := stream.Write(want); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(stream, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		stream.Close()
+	}
+
+	// redial after the connection is closed by server
+	s.Close()
+	s, err = NewServer(addr, srvTLSConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	time.Sleep(10 * time.Millisecond)
+	stream, err := d.DialContext(ctx, "tcp", e.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+}
+
+func TestDialNotBlocked(t *testing.T) {
+	// the server never replies
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	cliTLSConf, _, err := config.MutualTLS("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewStreamDialer(pc.LocalAddr().String(), cliTLSConf)
+	defer d.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go d.DialContext(ctx, "tcp", "127.0.0.1:80")
+	time.Sleep(10 * time.Millisecond)
+
+	// the pending dial does not block others
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel2()
+	start := time.Now()
+	if _, err = d.DialContext(ctx2, "tcp", "127.0.0.1:80"); err == nil {
+		t.Fatal("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("dial blocked for %s", elapsed)
+	}
+}
@@ -0,0 +1,110 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chenen3/yeager/internal/socksaddr"
+	"github.com/chenen3/yeager/logger"
+	"github.com/chenen3/yeager/transport"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// Server is a QUIC server for forward proxying
+type Server struct {
+	lis *quicgo.Listener
+
+	mu          sync.Mutex
+	activeConns map[quicgo.Connection]struct{}
+}
+
+// NewServer starts a QUIC server. The caller should call Close when finished.
+func NewServer(addr string, cfg *tls.Config) (*Server, error) {
+	cfg = cfg.Clone()
+	cfg.NextProtos = []string{nextProto}
+	lis, err := quicgo.ListenAddr(addr, cfg, &quicgo.Config{
+		KeepAlivePeriod: keepaliveInterval,
+		MaxIdleTimeout:  idleTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{lis: lis, activeConns: make(map[quicgo.Connection]struct{})}
+	go func() {
+		err := s.serve()
+		if err != nil {
+			logger.Error.Print(err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *Server) serve() error {
+	for {
+		conn, err := s.lis.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quicgo.ErrServerClosed) {
+				err = nil
+			}
+			return err
+		}
+		s.trackConn(conn, true)
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn quicgo.Connection) {
+	defer s.trackConn(conn, false)
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go handleStream(&streamConn{Stream: stream, local: conn.LocalAddr(), remote: conn.RemoteAddr()})
+	}
+}
+
+func handleStream(stream *streamConn) {
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	addr, err := socksaddr.Read(stream)
+	if err != nil {
+		logger.Debug.Printf("quic: read address: %s", err)
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		logger.Error.Print(err)
+		return
+	}
+	defer conn.Close()
+	if err = transport.Relay(stream, conn); err != nil {
+		logger.Debug.Printf("relay: %s", err)
+	}
+}
+
+func (s *Server) trackConn(c quicgo.Connection, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.activeConns[c] = struct{}{}
+	} else {
+		delete(s.activeConns, c)
+	}
+}
+
+func (s *Server) Close() error {
+	err := s.lis.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.activeConns {
+		c.CloseWithError(0, "")
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// RemoteListener is implemented by transports that support reverse tunnel.
+// Listen asks the server to listen on address, the connections accepted
+// by server are streamed back and returned by the Accept of listener.
+type RemoteListener interface {
+	Listen(ctx context.Context, address string) (net.Listener, error)
+}
+
+// RemoteAddr is the address listened by server of reverse tunnel
+type RemoteAddr string
+
+func (a RemoteAddr) Network() string { return "tcp" }
+func (a RemoteAddr) String() string  { return string(a) }
+
+// claimTimeout is how long an accepted connection waits for
+// the client to claim it
+const claimTimeout = 10 * time.Second
+
+// ReverseServer is the server side of reverse tunnel. It accepts connections
+// on behalf of clients, and holds each of them until the client claims it by ID.
+type ReverseServer struct {
+	mu      sync.Mutex
+	pending map[string]net.Conn
+}
+
+func NewReverseServer() *ReverseServer {
+	return &ReverseServer{pending: make(map[string]net.Conn)}
+}
+
+// Serve accepts connections on lis and passes the ID of each connection
+// to notify, blocking until ctx is done or notify fails. It closes lis
+// before returning.
+func (s *ReverseServer) Serve(ctx context.Context, lis net.Listener, notify func(id string) error) error {
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+	}()
+	defer lis.Close()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		id, err := s.hold(conn)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		if err = notify(id); err != nil {
+			if c, ok := s.Claim(id); ok {
+				c.Close()
+			}
+			return err
+		}
+	}
+}
+
+// hold keeps the connection until it is claimed or timeout
+func (s *ReverseServer) hold(conn net.Conn) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	s.mu.Lock()
+	s.pending[id] = conn
+	s.mu.Unlock()
+	time.AfterFunc(claimTimeout, func() {
+		if c, ok := s.Claim(id); ok {
+			c.Close()
+		}
+	})
+	return id, nil
+}
+
+// Claim returns the connection of id, it can be claimed only once
+func (s *ReverseServer) Claim(id string) (net.Conn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn, ok := s.pending[id]
+	if ok {
+		delete(s.pending, id)
+	}
+	return conn, ok
+}
+
+// ErrUnknownID is returned when the connection to claim does not exist
+var ErrUnknownID = errors.New("unknown connection ID")
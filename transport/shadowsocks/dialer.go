@@ -2,29 +2,155 @@ package shadowsocks
 
 import (
 	"context"
+	"errors"
 	"net"
 
 	sdk "github.com/Jigsaw-Code/outline-sdk/transport"
 	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/chenen3/yeager/transport"
 )
 
 type adaptor struct {
 	*shadowsocks.StreamDialer
+	packet sdk.PacketListener
 }
 
+var _ transport.Dialer = (*adaptor)(nil)
+var _ transport.PacketDialer = (*adaptor)(nil)
+
 func (d *adaptor) DialContext(ctx context.Context, network, raddr string) (net.Conn, error) {
 	return d.DialStream(ctx, raddr)
 }
 
-func NewDialer(address, cipherName, secret string) (*adaptor, error) {
+// DialPacket returns a connection that relays UDP datagrams to address
+// through the Shadowsocks server, which must support UDP relay.
+func (d *adaptor) DialPacket(ctx context.Context, address string) (net.Conn, error) {
+	if d.packet == nil {
+		return nil, errors.New("shadowsocks: UDP is not supported through base dialer")
+	}
+	pc, err := d.packet.ListenPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return &packetConn{PacketConn: pc, raddr: udpAddr(address), ip: net.ParseIP(host), port: port}, nil
+}
+
+// NewDialer returns a dialer of the Shadowsocks server. If base is not nil,
+// the connections to server are dialed through it, and UDP is not supported
+// since base carries streams only.
+func NewDialer(address, cipherName, secret string, base transport.Dialer) (*adaptor, error) {
 	key, err := shadowsocks.NewEncryptionKey(cipherName, secret)
 	if err != nil {
 		return nil, err
 	}
-	endpoint := &sdk.StreamDialerEndpoint{Dialer: &sdk.TCPDialer{}, Address: address}
+	var sd sdk.StreamDialer = &sdk.TCPDialer{}
+	if base != nil {
+		sd = baseDialer{base}
+	}
+	endpoint := &sdk.StreamDialerEndpoint{Dialer: sd, Address: address}
 	dialer, err := shadowsocks.NewStreamDialer(endpoint, key)
 	if err != nil {
 		return nil, err
 	}
-	return &adaptor{dialer}, nil
+	d := &adaptor{StreamDialer: dialer}
+	if base == nil {
+		d.packet, err = shadowsocks.NewPacketListener(&sdk.UDPEndpoint{Address: address}, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// baseDialer adapts transport.Dialer to sdk.StreamDialer
+type baseDialer struct {
+	transport.Dialer
+}
+
+func (d baseDialer) DialStream(ctx context.Context, raddr string) (sdk.StreamConn, error) {
+	conn, err := d.DialContext(ctx, "tcp", raddr)
+	if err != nil {
+		return nil, err
+	}
+	if sc, ok := conn.(sdk.StreamConn); ok {
+		return sc, nil
+	}
+	return streamConn{conn}, nil
+}
+
+// streamConn implements sdk.StreamConn, the half-close is
+// ignored if the underlying connection does not support it
+type streamConn struct {
+	net.Conn
+}
+
+func (c streamConn) CloseRead() error {
+	return nil
+}
+
+func (c streamConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// packetConn implements net.Conn, each Write sends a datagram
+// to the remote address and each Read receives a datagram from it.
+type packetConn struct {
+	net.PacketConn
+	raddr udpAddr
+	// the IP of remote address, if the host is a domain name,
+	// it is the IP of the first datagram from the port
+	ip   net.IP
+	port string
+}
+
+var _ net.Conn = (*packetConn)(nil)
+
+// Read reads a datagram, datagrams from other sources are dropped
+func (c *packetConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+		if c.fromRemote(addr) {
+			return n, nil
+		}
+	}
 }
+
+func (c *packetConn) fromRemote(addr net.Addr) bool {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil || port != c.port {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if c.ip == nil {
+		c.ip = ip
+	}
+	return c.ip.Equal(ip)
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.raddr)
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// udpAddr is the destination address, the host may be a domain name
+type udpAddr string
+
+func (a udpAddr) Network() string { return "udp" }
+func (a udpAddr) String() string  { return string(a) }
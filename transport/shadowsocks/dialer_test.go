@@ -0,0 +1,99 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/chenen3/yeager/echo"
+)
+
+// relayUDP is a minimal Shadowsocks UDP relay, which supports IPv4 only
+func relayUDP(t *testing.T, pc net.PacketConn, key *shadowsocks.EncryptionKey) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		plain, err := shadowsocks.Unpack(nil, buf[:n], key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// ATYP(0x01) IPv4 PORT
+		if len(plain) < 7 || plain[0] != 0x01 {
+			t.Errorf("unexpected address %v", plain)
+			return
+		}
+		target := &net.UDPAddr{IP: net.IP(plain[1:5]), Port: int(plain[5])<<8 | int(plain[6])}
+		conn, err := net.DialUDP("udp", nil, target)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write(plain[7:])
+		rn, err := conn.Read(buf)
+		conn.Close()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// a datagram from other port comes first, which the client must drop
+		other := append([]byte{}, plain[:7]...)
+		other[6]++
+		// the same source address followed by payload
+		for _, resp := range [][]byte{append(other, "other"...), append(plain[:7:7], buf[:rn]...)} {
+			out := make([]byte, key.SaltSize()+len(resp)+key.TagSize())
+			packed, err := shadowsocks.Pack(out, resp, key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			pc.WriteTo(packed, client)
+		}
+	}
+}
+
+func TestDialPacket(t *testing.T) {
+	es := echo.NewUDPServer()
+	defer es.Close()
+	key, err := shadowsocks.NewEncryptionKey("aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go relayUDP(t, pc, key)
+
+	d, err := NewDialer(pc.LocalAddr().String(), "aes-256-gcm", "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := d.DialPacket(ctx, es.PacketConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	want := "hello"
+	if _, err = conn.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 64)
+	n, err := conn.Read(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got[:n]) != want {
+		t.Fatalf("got %q, want %q", got[:n], want)
+	}
+}
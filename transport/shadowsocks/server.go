@@ -0,0 +1,211 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/chenen3/yeager/internal/socksaddr"
+	"github.com/chenen3/yeager/logger"
+	"github.com/chenen3/yeager/transport"
+)
+
+// Server is a Shadowsocks server, which relays the connections to
+// destinations directly. The salt of connections are remembered
+// to reject replayed connections.
+type Server struct {
+	key   *shadowsocks.EncryptionKey
+	salts *saltCache
+
+	mu         sync.Mutex
+	lis        net.Listener
+	activeConn map[net.Conn]struct{}
+}
+
+// NewServer starts a Shadowsocks server. The caller should call Close when finished.
+func NewServer(addr, cipherName, secret string) (*Server, error) {
+	key, err := shadowsocks.NewEncryptionKey(cipherName, secret)
+	if err != nil {
+		return nil, err
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		key:        key,
+		salts:      newSaltCache(saltCacheSize),
+		lis:        lis,
+		activeConn: make(map[net.Conn]struct{}),
+	}
+	go func() {
+		err := s.serve()
+		if err != nil {
+			logger.Error.Print(err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *Server) serve() error {
+	for {
+		conn, err := s.lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+			return err
+		}
+		s.trackConn(conn, true)
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.trackConn(conn, false)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	salt := make([]byte, s.key.SaltSize())
+	if _, err := io.ReadFull(conn, salt); err != nil {
+		logger.Debug.Printf("shadowsocks: read salt: %s", err)
+		return
+	}
+	r := shadowsocks.NewReader(io.MultiReader(bytes.NewReader(salt), conn), s.key)
+	addr, err := socksaddr.Read(r)
+	if err != nil {
+		// keep silent to resist active probing
+		logger.Debug.Printf("shadowsocks: %s: %s", conn.RemoteAddr(), err)
+		drain(conn)
+		return
+	}
+	// the salt is authentic, remember it after the decryption succeeds
+	if !s.salts.add(salt) {
+		logger.Error.Printf("shadowsocks: replayed connection from %s", conn.RemoteAddr())
+		drain(conn)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	target, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		logger.Error.Printf("connect %s: %s", addr, err)
+		return
+	}
+	defer target.Close()
+
+	w := shadowsocks.NewWriter(conn, s.key)
+	// the server salt must not be accepted as a client salt
+	w.SetSaltGenerator(saltGenerator{s.salts})
+	err = transport.Relay(&serverConn{Conn: conn, r: r, w: w}, target)
+	if err != nil {
+		logger.Debug.Printf("relay: %s", err)
+	}
+}
+
+// drain reads the connection until timeout, so that the
+// server does not reveal itself by closing early
+func drain(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	io.Copy(io.Discard, conn)
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.activeConn[c] = struct{}{}
+	} else {
+		delete(s.activeConn, c)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.lis.Close()
+	for c := range s.activeConn {
+		c.Close()
+	}
+	return err
+}
+
+// serverConn reads and writes the decrypted stream
+type serverConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *serverConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *serverConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *serverConn) CloseWrite() error {
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		return tc.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// saltCacheSize is the number of salts in each generation of cache,
+// replayed connections beyond two generations are not detected.
+const saltCacheSize = 1e5
+
+// saltCache remembers the salts in two generations, the older generation
+// is dropped when the newer one is full.
+type saltCache struct {
+	mu       sync.Mutex
+	capacity int
+	active   map[string]struct{}
+	archive  map[string]struct{}
+}
+
+func newSaltCache(capacity int) *saltCache {
+	return &saltCache{
+		capacity: capacity,
+		active:   make(map[string]struct{}),
+		archive:  make(map[string]struct{}),
+	}
+}
+
+// add reports whether the salt is new, and remembers it
+func (c *saltCache) add(salt []byte) bool {
+	key := string(salt)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.active[key]; ok {
+		return false
+	}
+	if _, ok := c.archive[key]; ok {
+		return false
+	}
+	if len(c.active) >= c.capacity {
+		c.archive = c.active
+		c.active = make(map[string]struct{})
+	}
+	c.active[key] = struct{}{}
+	return true
+}
+
+// saltGenerator generates random salt and remembers it
+type saltGenerator struct {
+	cache *saltCache
+}
+
+func (g saltGenerator) GetSalt(salt []byte) error {
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	g.cache.add(salt)
+	return nil
+}
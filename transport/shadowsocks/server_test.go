@@ -0,0 +1,109 @@
+package shadowsocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/chenen3/yeager/echo"
+)
+
+func TestServer(t *testing.T) {
+	es := echo.NewServer()
+	defer es.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.Close()
+	addr := lis.Addr().String()
+	s, err := NewServer(addr, "aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	d, err := NewDialer(addr, "aes-256-gcm", "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", es.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	want := "1"
+	if _, err = conn.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestServerReplay(t *testing.T) {
+	es := echo.NewServer()
+	defer es.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.Close()
+	addr := lis.Addr().String()
+	s, err := NewServer(addr, "aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// record the request, and send it twice
+	key, err := shadowsocks.NewEncryptionKey("aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := net.ResolveTCPAddr("tcp", es.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req recorder
+	w := shadowsocks.NewWriter(&req, key)
+	w.Write(append([]byte{0x01}, append(target.IP.To4(), byte(target.Port>>8), byte(target.Port), '1')...))
+
+	for i, wantEcho := range []bool{true, false} {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, err = conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		r := shadowsocks.NewReader(conn, key)
+		got := make([]byte, 1)
+		_, err = io.ReadFull(r, got)
+		conn.Close()
+		if wantEcho && (err != nil || string(got) != "1") {
+			t.Fatalf("connection %d: got %q, %v, want echo", i, got, err)
+		}
+		if !wantEcho && err == nil {
+			t.Fatalf("connection %d: replay was not rejected", i)
+		}
+	}
+}
+
+type recorder []byte
+
+func (r *recorder) Write(b []byte) (int, error) {
+	*r = append(*r, b...)
+	return len(b), nil
+}
@@ -0,0 +1,134 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/chenen3/yeager/internal/socksaddr"
+	"github.com/chenen3/yeager/transport"
+)
+
+const (
+	version5 = 0x05
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+	userPassVersion    = 0x01
+
+	cmdConnect = 0x01
+)
+
+// dialer establish a tunnel through the upstream SOCKS5 proxy
+type dialer struct {
+	proxyAddr string
+	username  string
+	password  string
+}
+
+var _ transport.Dialer = (*dialer)(nil)
+
+// NewDialer returns a new transport.StreamDialer that dials through the
+// SOCKS5 proxy. If username is not empty, it authenticates with RFC 1929.
+func NewDialer(proxyAddr, username, password string) *dialer {
+	return &dialer{proxyAddr: proxyAddr, username: username, password: password}
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// interrupt the handshake when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	err = d.handshake(conn, addr)
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *dialer) handshake(rw io.ReadWriter, addr string) error {
+	req, err := socksaddr.Append([]byte{version5, cmdConnect, 0x00}, addr)
+	if err != nil {
+		return err
+	}
+
+	method := byte(methodNoAuth)
+	if d.username != "" {
+		method = methodUserPass
+	}
+	if _, err = rw.Write([]byte{version5, 1, method}); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(rw, buf); err != nil {
+		return err
+	}
+	if buf[0] != version5 {
+		return fmt.Errorf("unexpected socks version: %x", buf[0])
+	}
+	if buf[1] == methodNoAcceptable || buf[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+	if method == methodUserPass {
+		if err = d.authenticate(rw); err != nil {
+			return err
+		}
+	}
+
+	if _, err = rw.Write(req); err != nil {
+		return err
+	}
+	// VER REP RSV, followed by BND.ADDR BND.PORT
+	reply := make([]byte, 3)
+	if _, err = io.ReadFull(rw, reply); err != nil {
+		return err
+	}
+	if reply[0] != version5 {
+		return fmt.Errorf("unexpected socks version: %x", reply[0])
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("socks connect failed with reply code %d", reply[1])
+	}
+	_, err = socksaddr.Read(rw)
+	return err
+}
+
+// authenticate with username and password, see RFC 1929
+func (d *dialer) authenticate(rw io.ReadWriter) error {
+	if len(d.username) > 255 || len(d.password) > 255 {
+		return errors.New("username or password too long")
+	}
+	req := []byte{userPassVersion, byte(len(d.username))}
+	req = append(req, d.username...)
+	req = append(req, byte(len(d.password)))
+	req = append(req, d.password...)
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return err
+	}
+	if resp[1] != 0x00 {
+		return errors.New("socks authentication failed")
+	}
+	return nil
+}
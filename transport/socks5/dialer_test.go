@@ -0,0 +1,79 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chenen3/yeager/echo"
+	"github.com/chenen3/yeager/proxy"
+)
+
+func TestDialer(t *testing.T) {
+	e := echo.NewServer()
+	defer e.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := proxy.NewSOCKS5Server(new(net.Dialer), "u", "p")
+	go s.Serve(lis)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if conn, err := NewDialer(lis.Addr().String(), "u", "x").DialContext(ctx, "tcp", e.Listener.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("expected error for wrong password")
+	}
+
+	conn, err := NewDialer(lis.Addr().String(), "u", "p").DialContext(ctx, "tcp", e.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	want := "1"
+	if _, err = conn.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestDialerContext(t *testing.T) {
+	// the upstream accepts connections but never responds
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = NewDialer(lis.Addr().String(), "", "").DialContext(ctx, "tcp", "127.0.0.1:80")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handshake is not interrupted, took %s", elapsed)
+	}
+}
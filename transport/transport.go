@@ -13,6 +13,19 @@ type Dialer interface {
 	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
+// PacketDialer is implemented by dialers that are able to carry UDP datagrams.
+// The returned connection preserves message boundaries, each Write sends
+// one datagram to addr and each Read receives one datagram from it.
+type PacketDialer interface {
+	DialPacket(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// Prober is implemented by transports whose server answers health checks,
+// so that clients measure the tunnel itself without third-party sites.
+type Prober interface {
+	Probe(ctx context.Context) error
+}
+
 type closeWriter interface {
 	CloseWrite() error
 }
@@ -0,0 +1,68 @@
+package trojan
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+
+	"github.com/chenen3/yeager/internal/socksaddr"
+	"github.com/chenen3/yeager/transport"
+)
+
+// Trojan request header:
+//
+//	hex(SHA224(password)) CRLF CMD ATYP DST.ADDR DST.PORT CRLF
+const (
+	hashLen    = 56
+	cmdConnect = 0x01
+)
+
+var crlf = []byte("\r\n")
+
+// hashPassword returns the hex encoded SHA224 of password
+func hashPassword(password string) []byte {
+	sum := sha256.Sum224([]byte(password))
+	b := make([]byte, hashLen)
+	hex.Encode(b, sum[:])
+	return b
+}
+
+type dialer struct {
+	addr string
+	cfg  *tls.Config
+	hash []byte
+}
+
+var _ transport.Dialer = (*dialer)(nil)
+
+// NewDialer returns a new transport.StreamDialer that dials through
+// the Trojan server, each stream takes a new TLS connection.
+// If cfg is nil, the server is verified with system root CAs.
+func NewDialer(addr string, cfg *tls.Config, password string) *dialer {
+	return &dialer{addr: addr, cfg: cfg, hash: hashPassword(password)}
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	header := make([]byte, 0, hashLen+2+1+1+255+2+2)
+	header = append(header, d.hash...)
+	header = append(header, crlf...)
+	header = append(header, cmdConnect)
+	header, err := socksaddr.Append(header, address)
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, crlf...)
+
+	td := &tls.Dialer{Config: d.cfg}
+	conn, err := td.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,96 @@
+package trojan
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/chenen3/yeager/config"
+	"github.com/chenen3/yeager/echo"
+)
+
+func TestTrojan(t *testing.T) {
+	e := echo.NewServer()
+	defer e.Close()
+	web := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "fallback")
+	})}
+	webLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go web.Serve(webLis)
+	defer web.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.Close()
+	addr := lis.Addr().String()
+	cliTLSConf, srvTLSConf, err := config.MutualTLS("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(addr, srvTLSConf, "secret", webLis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := NewDialer(addr, cliTLSConf, "secret").DialContext(ctx, "tcp", e.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	want := "1"
+	if _, err = conn.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// unauthenticated request is served by fallback
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: cliTLSConf},
+		Timeout:   time.Second,
+	}
+	resp, err := client.Get("https://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "fallback" {
+		t.Fatalf("got %q, want fallback", body)
+	}
+
+	// wrong password
+	conn, err = NewDialer(addr, cliTLSConf, "wrong").DialContext(ctx, "tcp", e.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,188 @@
+package trojan
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chenen3/yeager/internal/socksaddr"
+	"github.com/chenen3/yeager/logger"
+	"github.com/chenen3/yeager/transport"
+)
+
+// Server is a Trojan server for forward proxying. Connections that fail
+// the authentication are relayed to the fallback web server, so that the
+// server looks like an ordinary HTTPS website to active probing.
+type Server struct {
+	hash     []byte
+	fallback string
+
+	mu         sync.Mutex
+	lis        net.Listener
+	activeConn map[net.Conn]struct{}
+}
+
+// NewServer starts a Trojan server. If fallback is empty, unauthenticated
+// connections are drained and closed. The caller should call Close when finished.
+func NewServer(addr string, cfg *tls.Config, password, fallback string) (*Server, error) {
+	lis, err := tls.Listen("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		hash:       hashPassword(password),
+		fallback:   fallback,
+		lis:        lis,
+		activeConn: make(map[net.Conn]struct{}),
+	}
+	go func() {
+		err := s.serve()
+		if err != nil {
+			logger.Error.Print(err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *Server) serve() error {
+	for {
+		conn, err := s.lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+			return err
+		}
+		s.trackConn(conn, true)
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.trackConn(conn, false)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	head, err := readHash(conn)
+	if err != nil {
+		logger.Debug.Printf("trojan: %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	if len(head) != hashLen+len(crlf) || subtle.ConstantTimeCompare(head[:hashLen], s.hash) != 1 {
+		s.serveFallback(conn, head)
+		return
+	}
+
+	var cmd [1]byte
+	if _, err = io.ReadFull(conn, cmd[:]); err != nil {
+		logger.Debug.Printf("trojan: %s", err)
+		return
+	}
+	if cmd[0] != cmdConnect {
+		logger.Error.Printf("trojan: unsupported command: %x", cmd[0])
+		return
+	}
+	addr, err := socksaddr.Read(conn)
+	if err != nil {
+		logger.Debug.Printf("trojan: %s", err)
+		return
+	}
+	var tail [2]byte
+	if _, err = io.ReadFull(conn, tail[:]); err != nil {
+		logger.Debug.Printf("trojan: %s", err)
+		return
+	}
+	if !bytes.Equal(tail[:], crlf) {
+		logger.Debug.Printf("trojan: %s: malformed request", conn.RemoteAddr())
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	target, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		logger.Error.Printf("connect %s: %s", addr, err)
+		return
+	}
+	defer target.Close()
+	if err = transport.Relay(conn, target); err != nil {
+		logger.Debug.Printf("relay: %s", err)
+	}
+}
+
+// readHash reads the password hash and CRLF. It stops early once the data
+// is not in the form of hex digits and CRLF, and returns the bytes read,
+// so that other protocols such as HTTP do not wait for the full length.
+func readHash(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 0, hashLen+len(crlf))
+	for len(buf) < cap(buf) {
+		start := len(buf)
+		n, err := r.Read(buf[start:cap(buf)])
+		for _, c := range buf[start : start+n] {
+			if !validHashByte(len(buf), c) {
+				return buf[:start+n], nil
+			}
+			buf = buf[:len(buf)+1]
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// validHashByte reports whether c is valid at offset i of the header
+func validHashByte(i int, c byte) bool {
+	if i >= hashLen {
+		return c == crlf[i-hashLen]
+	}
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f'
+}
+
+// serveFallback relays the connection along with the bytes read to fallback
+func (s *Server) serveFallback(conn net.Conn, head []byte) {
+	if s.fallback == "" {
+		logger.Debug.Printf("trojan: %s: authentication failed", conn.RemoteAddr())
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		io.Copy(io.Discard, conn)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	fb, err := net.DialTimeout("tcp", s.fallback, 5*time.Second)
+	if err != nil {
+		logger.Error.Printf("trojan fallback: %s", err)
+		return
+	}
+	defer fb.Close()
+	if _, err = fb.Write(head); err != nil {
+		logger.Error.Printf("trojan fallback: %s", err)
+		return
+	}
+	if err = transport.Relay(conn, fb); err != nil {
+		logger.Debug.Printf("relay: %s", err)
+	}
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.activeConn[c] = struct{}{}
+	} else {
+		delete(s.activeConn, c)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.lis.Close()
+	for c := range s.activeConn {
+		c.Close()
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/chenen3/yeager/internal/netutil"
+	"github.com/chenen3/yeager/transport"
+	ws "golang.org/x/net/websocket"
+)
+
+// addressHeader carries the destination address in the handshake request
+const addressHeader = "X-Address"
+
+type dialer struct {
+	addr     string
+	path     string
+	cfg      *tls.Config
+	username string
+	password string
+}
+
+var _ transport.Dialer = (*dialer)(nil)
+
+// NewStreamDialer returns a new transport.StreamDialer that dials through
+// the WebSocket server over TLS, each stream takes a new connection.
+// If cfg is nil, the default TLS config is used. If username is not empty,
+// the handshake request carries the Basic Authorization.
+func NewStreamDialer(addr string, cfg *tls.Config, path, username, password string) *dialer {
+	if path == "" {
+		path = "/"
+	}
+	return &dialer{addr: addr, path: path, cfg: cfg, username: username, password: password}
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	config, err := ws.NewConfig("wss://"+d.addr+d.path, "https://"+d.addr)
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = d.cfg
+	config.Header = http.Header{}
+	config.Header.Set(addressHeader, address)
+	if d.username != "" {
+		config.Header.Set("Authorization", netutil.BasicAuth(d.username, d.password))
+	}
+	conn, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn.PayloadType = ws.BinaryFrame
+	return &stream{conn}, nil
+}
+
+// stream implements net.Conn, io.WriterTo, and io.ReaderFrom,
+// each Write sends a binary frame.
+type stream struct {
+	*ws.Conn
+}
+
+var _ io.WriterTo = (*stream)(nil)
+var _ io.ReaderFrom = (*stream)(nil)
+
+// WriteTo uses buffer from pool, instead of allocating a new one
+func (s *stream) WriteTo(w io.Writer) (written int64, err error) {
+	return netutil.Copy(w, s.Conn)
+}
+
+// ReadFrom sends each read as a frame, using buffer from pool
+func (s *stream) ReadFrom(r io.Reader) (n int64, err error) {
+	return netutil.Copy(s.Conn, r)
+}
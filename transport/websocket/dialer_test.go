@@ -0,0 +1,66 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chenen3/yeager/config"
+	"github.com/chenen3/yeager/echo"
+)
+
+func TestWebSocket(t *testing.T) {
+	e := echo.NewServer()
+	defer e.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.Close()
+	addr := lis.Addr().String()
+	cliTLSConf, srvTLSConf, err := config.MutualTLS("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(addr, srvTLSConf, "/ws", "u", "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// the server may not started yet
+	time.Sleep(time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, d := range []*dialer{
+		NewStreamDialer(addr, cliTLSConf, "/ws", "u", "x"),
+		NewStreamDialer(addr, cliTLSConf, "/", "u", "p"),
+	} {
+		if conn, err := d.DialContext(ctx, "tcp", e.Listener.Addr().String()); err == nil {
+			conn.Close()
+			t.Fatalf("expected error for path %s, username %s, password %s", d.path, d.username, d.password)
+		}
+	}
+
+	d := NewStreamDialer(addr, cliTLSConf, "/ws", "u", "p")
+	stream, err := d.DialContext(ctx, "tcp", e.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Second))
+	want := []byte{1}
+	got := make([]byte, len(want))
+	if _, err := stream.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
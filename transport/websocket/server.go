@@ -0,0 +1,120 @@
+package websocket
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chenen3/yeager/internal/netutil"
+	"github.com/chenen3/yeager/logger"
+	ws "golang.org/x/net/websocket"
+)
+
+// Server is a WebSocket server for forward proxying
+type Server struct {
+	srv  *http.Server
+	auth []byte
+
+	mu         sync.Mutex
+	activeConn map[*ws.Conn]struct{}
+}
+
+// NewServer starts a WebSocket server that serves on the path. If cfg is nil,
+// it serves plain HTTP, which is supposed to be behind a TLS-terminating
+// reverse proxy or CDN. If username is not empty, the handshake request
+// must carry the Basic Authorization. The caller should call Close when finished.
+func NewServer(addr string, cfg *tls.Config, path, username, password string) (*Server, error) {
+	var lis net.Listener
+	var err error
+	if cfg != nil {
+		lis, err = tls.Listen("tcp", addr, cfg)
+	} else {
+		lis, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		path = "/"
+	}
+	s := &Server{activeConn: make(map[*ws.Conn]struct{})}
+	if username != "" {
+		s.auth = []byte(netutil.BasicAuth(username, password))
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, ws.Server{Handshake: s.handshake, Handler: s.handle})
+	s.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := s.srv.Serve(lis)
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error.Print(err)
+		}
+	}()
+	return s, nil
+}
+
+// handshake checks the authorization, the origin is ignored
+// since clients are not browsers
+func (s *Server) handshake(_ *ws.Config, r *http.Request) error {
+	if r.Header.Get(addressHeader) == "" {
+		return errors.New("missing address")
+	}
+	if len(s.auth) == 0 {
+		return nil
+	}
+	auth := r.Header.Get("Authorization")
+	prefix := "Basic "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) ||
+		subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), s.auth[len(prefix):]) != 1 {
+		return errors.New("invalid authorization")
+	}
+	return nil
+}
+
+func (s *Server) handle(conn *ws.Conn) {
+	s.trackConn(conn, true)
+	defer s.trackConn(conn, false)
+	conn.PayloadType = ws.BinaryFrame
+	address := conn.Request().Header.Get(addressHeader)
+	target, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		logger.Error.Print(err)
+		return
+	}
+	defer target.Close()
+
+	st := &stream{conn}
+	go func() {
+		st.WriteTo(target)
+		if tc, ok := target.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	st.ReadFrom(target)
+}
+
+func (s *Server) trackConn(c *ws.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.activeConn[c] = struct{}{}
+	} else {
+		delete(s.activeConn, c)
+	}
+}
+
+func (s *Server) Close() error {
+	err := s.srv.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.activeConn {
+		c.Close()
+	}
+	return err
+}